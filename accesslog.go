@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestIDHeader holds the id of a request, which is generated when the client doesn't send one.
+const requestIDHeader = "X-Request-Id"
+
+const redacted = "[REDACTED]"
+
+// queryInfo collects what is logged about a query while it is handled.
+type queryInfo struct {
+	requestID string
+	principal string
+	tenant    string
+	operation string
+	queryHash string
+	variables map[string]interface{}
+	cost      int
+	codes     []string
+}
+
+type queryInfoKey struct{}
+
+func withQueryInfo(ctx context.Context, info *queryInfo) context.Context {
+	return context.WithValue(ctx, queryInfoKey{}, info)
+}
+
+func queryInfoFromContext(ctx context.Context) *queryInfo {
+	info, _ := ctx.Value(queryInfoKey{}).(*queryInfo)
+	return info
+}
+
+// queryHash identifies a query in the logs without logging the query, which may hold personal data.
+func queryHash(query string) string {
+	hash := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(hash[:])
+}
+
+// responseRecorder records the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.size += n
+	return n, err
+}
+
+// accessLog writes a JSON line for every request handled by next.
+func accessLog(logger *slog.Logger, config Logging, next http.Handler) http.Handler {
+	pii := strings.Split(config.PII, ",")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &queryInfo{requestID: r.Header.Get(requestIDHeader)}
+		if info.requestID == "" {
+			info.requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, info.requestID)
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(withQueryInfo(r.Context(), info)))
+
+		attributes := []slog.Attr{
+			slog.String("requestId", info.requestID),
+			slog.String("operation", info.operation),
+			slog.String("queryHash", info.queryHash),
+			slog.Float64("durationMs", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("status", recorder.status),
+			slog.Int("responseSize", recorder.size),
+		}
+		if info.principal != "" {
+			attributes = append(attributes, slog.String("principal", info.principal))
+		}
+		if info.tenant != "" {
+			attributes = append(attributes, slog.String("tenant", info.tenant))
+		}
+		if info.cost > 0 {
+			attributes = append(attributes, slog.Int("cost", info.cost))
+		}
+		if len(info.codes) > 0 {
+			attributes = append(attributes, slog.Any("errorCodes", info.codes))
+		}
+		switch {
+		case info.variables == nil || config.Variables == "omit":
+		case config.Variables == "redact" || config.Variables == "mask":
+			attributes = append(attributes, slog.Any("variables", redactVariables(info.variables, pii, "", config.Variables == "mask")))
+		default:
+			attributes = append(attributes, slog.Any("variables", info.variables))
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "query", attributes...)
+	})
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// redactVariables returns a copy of the variables in which the values at the
+// given field paths are redacted, or masked as the field of a person at the path
+// is masked. A path matches at any depth, so email redacts both $email and
+// $input.email.
+func redactVariables(variables map[string]interface{}, paths []string, prefix string, mask bool) map[string]interface{} {
+	copied := make(map[string]interface{}, len(variables))
+	for name, value := range variables {
+		path := prefix + name
+		if matched := matchPath(path, paths); matched != "" {
+			copied[name] = redacted
+			if s, ok := value.(string); ok && mask && personMasks[matched] != "" {
+				copied[name] = maskValue(maskPolicy, matched, s)
+			}
+			continue
+		}
+		copied[name] = redactValue(value, paths, path, mask)
+	}
+	return copied
+}
+
+func redactValue(value interface{}, paths []string, path string, mask bool) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return redactVariables(value, paths, path+".", mask)
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, element := range value {
+			copied[i] = redactValue(element, paths, path, mask)
+		}
+		return copied
+	}
+	return value
+}
+
+// matchPath returns the given path that matches the end of path, if any.
+func matchPath(path string, paths []string) string {
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p != "" && (path == p || strings.HasSuffix(path, "."+p)) {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var logged bytes.Buffer
+	config := defaultConfig()
+	handler := accessLog(slog.New(slog.NewJSONHandler(&logged, nil)), config.Logging, queryHandler(newFileStore("data.bin"), config, nil))
+
+	body := `{"query": "query Find($id: Int) { person(id: $id) { name } }", "variables": {"id": 32, "input": "x", "email": "jaap@joosten", "filter": {"phone": {"number": "053218622189"}}}}`
+	request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(body))
+	request.Header.Set(requestIDHeader, "request-1")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	var line map[string]interface{}
+	err := json.Unmarshal(logged.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line["requestId"] != "request-1" || line["operation"] != "Find" || line["status"] != float64(http.StatusOK) {
+		t.Fatalf("unexpected access log %s", logged.Bytes())
+	}
+	if line["queryHash"] != queryHash("query Find($id: Int) { person(id: $id) { name } }") {
+		t.Fatalf("unexpected query hash in %s", logged.Bytes())
+	}
+	if line["responseSize"] != float64(response.Body.Len()) {
+		t.Fatalf("unexpected response size in %s", logged.Bytes())
+	}
+
+	expected := map[string]interface{}{
+		"id":     float64(32),
+		"input":  "x",
+		"email":  redacted,
+		"filter": map[string]interface{}{"phone": map[string]interface{}{"number": redacted}},
+	}
+	if !reflect.DeepEqual(expected, line["variables"]) {
+		t.Fatalf("unexpected variables %v", line["variables"])
+	}
+
+	logged.Reset()
+	request = httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person { unknown } }"}`))
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	err = json.Unmarshal(logged.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]interface{}{codeValidationFailed}, line["errorCodes"]) || line["requestId"] == "" {
+		t.Fatalf("unexpected access log %s", logged.Bytes())
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/graphql-go/graphql"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"sort"
+	"sync"
+	"time"
+)
+
+// auditRecord is a record in the audit log of who read or changed which people.
+// Every record holds the hash of the record before it, so a record can't be
+// changed or removed without breaking the chain.
+type auditRecord struct {
+	Seq       uint64        `json:"seq"`
+	Time      time.Time     `json:"time"`
+	Principal string        `json:"principal,omitempty"`
+	Operation string        `json:"operation,omitempty"`
+	Tenant    string        `json:"tenant,omitempty"`
+	IDs       []int32       `json:"ids"`
+	Fields    []string      `json:"fields,omitempty"`
+	Changes   []auditChange `json:"changes,omitempty"`
+	Prev      string        `json:"prev"`
+	Hash      string        `json:"hash"`
+}
+
+// auditChange is a changed field of a person. The values of fields with a mask in
+// models.proto are recorded as their SHA-256 hash, so the log holds no PII in clear text.
+type auditChange struct {
+	ID   int32  `json:"id"`
+	Path string `json:"path"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// hash returns the hash of the record, which covers all fields but the hash itself.
+func (r auditRecord) hash() string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditHead is the sequence number and hash of the last record of an audit log,
+// which is kept next to the log, so records cut off its end are detected.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// auditHeadPath returns the path of the head of the audit log at path.
+func auditHeadPath(path string) string {
+	return path + ".head"
+}
+
+// auditLog appends records to an audit log file.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	seq  uint64
+	prev string
+}
+
+// openAuditLog opens the audit log at path for appending, after verifying the
+// records in it. It returns nil when path is empty.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	l := &auditLog{path: path}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	last, err := verifyAuditFile(path, file, func(auditRecord) {})
+	if err == nil {
+		// records appended after the head was last written are chained
+		l.seq, l.prev = last.Seq, last.Hash
+		err = l.writeHead()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open audit log %s: %v", path, err)
+	}
+	l.file = file
+	return l, nil
+}
+
+// writeHead replaces the head of the log with its last record.
+func (l *auditLog) writeHead() error {
+	data, err := json.Marshal(auditHead{Seq: l.seq, Hash: l.prev})
+	if err != nil {
+		return err
+	}
+	tmp := auditHeadPath(l.path) + ".tmp"
+	err = writeFile(tmp, data)
+	if err == nil {
+		err = os.Rename(tmp, auditHeadPath(l.path))
+	}
+	return err
+}
+
+// append chains the record to the log and writes it.
+func (l *auditLog) append(record auditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record.Seq, record.Prev = l.seq+1, l.prev
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	record.Hash = record.hash()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	l.seq, l.prev = record.Seq, record.Hash
+	err = l.writeHead()
+	if err != nil {
+		return fmt.Errorf("failed to write audit log head: %v", err)
+	}
+	return nil
+}
+
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// verifyAudit checks that the records in r form an unbroken chain, calling fn for
+// every verified record.
+func verifyAudit(r io.Reader, fn func(record auditRecord)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	seq, prev := uint64(0), ""
+	for scanner.Scan() {
+		var record auditRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return fmt.Errorf("record %d: %v", seq+1, err)
+		}
+		switch {
+		case record.Seq != seq+1:
+			return fmt.Errorf("record %d: unexpected sequence number %d", seq+1, record.Seq)
+		case record.Prev != prev:
+			return fmt.Errorf("record %d: chain broken, previous hash %s instead of %s", record.Seq, record.Prev, prev)
+		case record.Hash != record.hash():
+			return fmt.Errorf("record %d: hash mismatch, the record was changed", record.Seq)
+		}
+		fn(record)
+		seq, prev = record.Seq, record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("record %d: %v", seq+1, err)
+	}
+	return nil
+}
+
+// verifyAuditFile verifies the chain of the audit log at path, read from r, and
+// checks that it ends at or after its head. It returns the last record.
+func verifyAuditFile(path string, r io.Reader, fn func(record auditRecord)) (auditRecord, error) {
+	var head auditHead
+	data, err := ioutil.ReadFile(auditHeadPath(path))
+	missing := os.IsNotExist(err)
+	if err == nil {
+		err = json.Unmarshal(data, &head)
+	}
+	if err != nil && !missing {
+		return auditRecord{}, fmt.Errorf("failed to read head: %v", err)
+	}
+
+	var last auditRecord
+	found := head.Seq == 0
+	err = verifyAudit(r, func(record auditRecord) {
+		if record.Seq == head.Seq {
+			found = record.Hash == head.Hash
+		}
+		last = record
+		fn(record)
+	})
+	if err != nil {
+		return last, err
+	}
+	if last.Seq > 0 && missing {
+		return last, fmt.Errorf("the head of the log is missing")
+	}
+	if !found {
+		return last, fmt.Errorf("the log ends at record %d, but its head is record %d %s: records were removed", last.Seq, head.Seq, head.Hash)
+	}
+	return last, nil
+}
+
+// verifyAuditCommand verifies the hash chain of an audit log.
+func verifyAuditCommand(args []string) error {
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: verify-audit audit.log")
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	last, err := verifyAuditFile(flags.Arg(0), file, func(auditRecord) {})
+	if err != nil {
+		return fmt.Errorf("audit log %s is not intact: %v", flags.Arg(0), err)
+	}
+	fmt.Printf("verified %d records, last hash %s\n", last.Seq, last.Hash)
+	return nil
+}
+
+// commandPrincipal is the principal of the changes made by commands, which is the
+// user that runs them.
+func commandPrincipal() *Principal {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	return &Principal{Subject: "user:" + name}
+}
+
+// auditTrail collects the people a request reads and changes.
+type auditTrail struct {
+	mu        sync.Mutex
+	operation string
+	ids       map[int32]bool
+	fields    map[string]bool
+	changes   []auditChange
+}
+
+func newAuditTrail(operation string) *auditTrail {
+	return &auditTrail{operation: operation, ids: make(map[int32]bool), fields: make(map[string]bool)}
+}
+
+type auditTrailKey struct{}
+
+func withAuditTrail(ctx context.Context, trail *auditTrail) context.Context {
+	return context.WithValue(ctx, auditTrailKey{}, trail)
+}
+
+func auditTrailFromContext(ctx context.Context) *auditTrail {
+	trail, _ := ctx.Value(auditTrailKey{}).(*auditTrail)
+	return trail
+}
+
+func (t *auditTrail) read(id int32, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id != 0 {
+		t.ids[id] = true
+	}
+	if path != "" {
+		t.fields[path] = true
+	}
+}
+
+func (t *auditTrail) changed(before, after *models.Person) {
+	id := after.GetId()
+	if after == nil {
+		id = before.GetId()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ids[id] = true
+	for _, change := range models.Diff(before, after) {
+		oldValue, newValue := fmt.Sprint(change.Old), fmt.Sprint(change.New)
+		// the values are keyed hashes, which can't be reversed by hashing guesses
+		if _, ok := personMasks[change.Path]; ok {
+			oldValue, newValue = maskValue(hashPolicy, change.Path, oldValue), maskValue(hashPolicy, change.Path, newValue)
+		}
+		t.changes = append(t.changes, auditChange{ID: id, Path: change.Path, Old: oldValue, New: newValue})
+	}
+}
+
+// record returns the audit record of the trail, with the people in order, and
+// starts a new trail.
+func (t *auditTrail) record(principal *Principal) auditRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record := auditRecord{Operation: t.operation, IDs: make([]int32, 0, len(t.ids)), Changes: t.changes}
+	if principal != nil {
+		record.Principal = principal.Subject
+	}
+	for id := range t.ids {
+		record.IDs = append(record.IDs, id)
+	}
+	sort.Slice(record.IDs, func(i, j int) bool { return record.IDs[i] < record.IDs[j] })
+	for field := range t.fields {
+		record.Fields = append(record.Fields, field)
+	}
+	sort.Strings(record.Fields)
+
+	t.ids, t.fields, t.changes = make(map[int32]bool), make(map[string]bool), nil
+	return record
+}
+
+// middleware collects the people a query reads and changes, and appends them to
+// the audit log after the query. Queries that touch no people aren't logged. The
+// response is held back until the record is written, and replaced by an error when
+// it can't be, so no query is answered without its record.
+func (l *auditLog) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trail := newAuditTrail("")
+		response := &heldResponse{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(response, r.WithContext(withAuditTrail(r.Context(), trail)))
+
+		record := trail.record(principalFromContext(r.Context()))
+		if len(record.IDs) > 0 {
+			if tenant := tenantFromContext(r.Context()); tenant != nil {
+				record.Tenant = tenant.name
+			}
+			if err := l.append(record); err != nil {
+				log.Print(err)
+				rejectRequest(w, r, http.StatusInternalServerError, "AUDIT_FAILED", "the request could not be audited")
+				return
+			}
+		}
+		response.send(w)
+	})
+}
+
+// heldResponse keeps a response until it is sent.
+type heldResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (h *heldResponse) Header() http.Header {
+	return h.header
+}
+
+func (h *heldResponse) WriteHeader(status int) {
+	h.status = status
+}
+
+func (h *heldResponse) Write(data []byte) (int, error) {
+	return h.body.Write(data)
+}
+
+func (h *heldResponse) send(w http.ResponseWriter) {
+	for name, values := range h.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(h.status)
+	w.Write(h.body.Bytes())
+}
+
+// auditFields records the fields of an object that are read, which holds the
+// person's fields at the given path.
+func auditFields(object *graphql.Object, prefix string) {
+	wrapResolvers(object, func(name string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+		path := prefix + name
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			value, err := resolve(p)
+			if trail := auditTrailFromContext(p.Context); trail != nil && err == nil {
+				person, _ := sourcePerson(p.Source)
+				trail.read(person.GetId(), path)
+			}
+			return value, err
+		}
+	})
+}
+
+// auditStore records the changes to the people in the store in the audit trail.
+type auditStore struct {
+	store PersonStore
+	trail *auditTrail
+}
+
+// recordChanges returns the store that records its changes in the audit trail of
+// the request, if it has one.
+func recordChanges(ctx context.Context, store PersonStore) PersonStore {
+	trail := auditTrailFromContext(ctx)
+	if trail == nil {
+		return store
+	}
+	return &auditStore{store: store, trail: trail}
+}
+
+func (s *auditStore) Person(id int32) (*models.Person, error) {
+	return s.store.Person(id)
+}
+
+func (s *auditStore) ForEach(fn func(person *models.Person) error) error {
+	return s.store.ForEach(fn)
+}
+
+func (s *auditStore) Put(people ...*models.Person) error {
+	ids := make(map[int32]bool, len(people))
+	for _, person := range people {
+		ids[person.Id] = true
+	}
+	before := make(map[int32]*models.Person, len(people))
+	err := s.store.ForEach(func(person *models.Person) error {
+		if ids[person.Id] {
+			before[person.Id] = person
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = s.store.Put(people...)
+	if err != nil {
+		return err
+	}
+	for _, person := range people {
+		s.trail.changed(before[person.Id], person)
+	}
+	return nil
+}
+
+func (s *auditStore) Delete(id int32) error {
+	person, err := s.store.Person(id)
+	if err != nil {
+		return err
+	}
+	err = s.store.Delete(id)
+	if err != nil || person == nil {
+		return err
+	}
+	s.trail.changed(person, nil)
+	return nil
+}
+
+func (s *auditStore) History(id int32) ([]Version, error) {
+	return s.store.History(id)
+}
+
+func (s *auditStore) Close() error {
+	return s.store.Close()
+}
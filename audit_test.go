@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readAudit returns the records in an audit log, after verifying it.
+func readAudit(t *testing.T, path string) []auditRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []auditRecord
+	err = verifyAudit(file, func(record auditRecord) { records = append(records, record) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int32{32, 33} {
+		err = audit.append(auditRecord{Principal: "support", IDs: []int32{id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit.Close()
+
+	// a reopened log continues the chain
+	audit, err = openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = audit.append(auditRecord{Principal: "support", IDs: []int32{34}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+
+	records := readAudit(t, path)
+	if len(records) != 3 || records[2].Seq != 3 || records[2].Prev != records[1].Hash {
+		t.Fatalf("unexpected records %v", records)
+	}
+	err = verifyAuditCommand([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ioutil.ReadFile(auditHeadPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(auditHeadPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifyAuditCommand([]string{path}) == nil {
+		t.Fatal("missing head not detected")
+	}
+	err = ioutil.WriteFile(auditHeadPath(path), head, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	for name, tampered := range map[string]string{
+		"changed":   strings.Replace(string(data), `"ids":[33]`, `"ids":[40]`, 1),
+		"removed":   lines[0] + lines[2],
+		"swapped":   lines[1] + lines[0] + lines[2],
+		"truncated": lines[0] + lines[1],
+	} {
+		err = ioutil.WriteFile(path, []byte(tampered), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verifyAuditCommand([]string{path}) == nil {
+			t.Fatalf("%s record not detected", name)
+		}
+		if _, err = openAuditLog(path); err == nil {
+			t.Fatalf("opened audit log with a %s record", name)
+		}
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	auth, err := authenticate(Auth{APIKeys: []APIKey{{Key: "support", Subject: "support", Scopes: []string{"pii:read"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth(audit.middleware(queryHandler(newFileStore("data.bin"), defaultConfig(), nil)))
+
+	for _, query := range []string{
+		"query Find { person(id: 32) { name phone { number } } }",
+		"{ person(id: 40) { name } }",
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "`+query+`"}`))
+		request.Header.Set(apiKeyHeader, "support")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+		}
+	}
+
+	// the query on a person that isn't stored reads nobody
+	records := readAudit(t, path)
+	if len(records) != 1 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	record := records[0]
+	if record.Principal != "support" || record.Operation != "Find" || !reflect.DeepEqual(record.IDs, []int32{32}) {
+		t.Fatalf("unexpected record %v", record)
+	}
+	if !reflect.DeepEqual(record.Fields, []string{"name", "phone", "phone.number"}) {
+		t.Fatalf("unexpected fields %v", record.Fields)
+	}
+
+	// a query whose record can't be written isn't answered
+	audit.file.Close()
+	request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person(id: 32) { name } }"}`))
+	request.Header.Set(apiKeyHeader, "support")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusInternalServerError || strings.Contains(response.Body.String(), "Jaap") {
+		t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+	}
+}
+
+func TestAuditImport(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	data, path := filepath.Join(dir, "data.bin"), filepath.Join(dir, "audit.log")
+	defer useHashKey("")
+
+	for i, people := range []string{
+		`{"id":32,"name":"Jaap Joosten"}` + "\n" + `{"id":33,"name":"Anna Joosten"}`,
+		`{"id":32,"name":"Jaap Joosten","email":"jaap@joosten"}`,
+	} {
+		in := filepath.Join(dir, "people.ndjson")
+		err := ioutil.WriteFile(in, []byte(people), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = importCommand([]string{"-data", data, "-audit", path, "-hash-key", testHashKey, in})
+		if err != nil {
+			t.Fatalf("import %d: %v", i, err)
+		}
+	}
+
+	records := readAudit(t, path)
+	if len(records) != 2 || records[0].Operation != "import" || !strings.HasPrefix(records[0].Principal, "user:") {
+		t.Fatalf("unexpected records %v", records)
+	}
+	if !reflect.DeepEqual(records[0].IDs, []int32{32, 33}) {
+		t.Fatalf("unexpected ids %v", records[0].IDs)
+	}
+	changes, _ := json.Marshal(records[1].Changes)
+	// the values of fields with a mask are hashed
+	if string(changes) != `[{"id":32,"path":"email","old":"","new":"`+keyedHash("jaap@joosten")+`"}]` {
+		t.Fatalf("unexpected changes %s", changes)
+	}
+
+	// the changed fields aren't recorded without the key of their hashes
+	useHashKey("")
+	err := importCommand([]string{"-data", data, "-audit", path, filepath.Join(dir, "people.ndjson")})
+	if err == nil {
+		t.Fatal("audited an import without a masking hash key")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// apiKeyHeader holds the API key of a request.
+const apiKeyHeader = "X-API-Key"
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Scopes  []string
+	// Claims are the claims of the token or the claims configured for the API key.
+	Claims map[string]interface{}
+}
+
+// HasScope reports whether the principal is granted the given scope.
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Role returns the role claim of the principal, which decides how the fields it
+// isn't authorized for are masked.
+func (p *Principal) Role() string {
+	if p == nil {
+		return ""
+	}
+	role, _ := p.Claims["role"].(string)
+	return role
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFromContext returns the authenticated caller of a request, or nil
+// for anonymous requests.
+func principalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// authenticator authenticates the caller of a request. It returns nil without an
+// error when the request doesn't hold its kind of credentials.
+type authenticator interface {
+	authenticate(r *http.Request) (*Principal, error)
+}
+
+// authConfigured reports whether the server has credentials configured, so its
+// requests are authenticated.
+func authConfigured(config Auth) bool {
+	return len(config.APIKeys) > 0 || config.JWKS != ""
+}
+
+// authenticate returns the middleware that authenticates requests with API keys
+// and JWT bearer tokens as configured. Requests without credentials are anonymous,
+// unless authentication is required. Without credentials configured, requests
+// aren't authenticated at all.
+func authenticate(config Auth) (mux.MiddlewareFunc, error) {
+	var authenticators []authenticator
+	if len(config.APIKeys) > 0 {
+		authenticators = append(authenticators, apiKeyAuthenticator(config.APIKeys))
+	}
+	if config.JWKS != "" {
+		keys, err := loadJWKS(config.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, &jwtAuthenticator{keys: keys, issuer: config.Issuer, audience: config.Audience})
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(authenticators) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var principal *Principal
+			for _, authenticator := range authenticators {
+				var err error
+				principal, err = authenticator.authenticate(r)
+				if err != nil {
+					unauthenticated(w, r, err.Error())
+					return
+				}
+				if principal != nil {
+					break
+				}
+			}
+
+			if principal == nil && config.Required {
+				unauthenticated(w, r, "authentication required")
+				return
+			}
+			if info := queryInfoFromContext(r.Context()); info != nil && principal != nil {
+				info.principal = principal.Subject
+			}
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+		})
+	}, nil
+}
+
+func unauthenticated(w http.ResponseWriter, r *http.Request, message string) {
+	if charge := authFailureFromContext(r.Context()); charge != nil {
+		charge()
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	rejectRequest(w, r, http.StatusUnauthorized, "UNAUTHENTICATED", message)
+}
+
+// apiKeyAuthenticator authenticates requests by the static API keys in the configuration.
+type apiKeyAuthenticator []APIKey
+
+func (keys apiKeyAuthenticator) authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	for _, configured := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(configured.Key)) == 1 {
+			return &Principal{Subject: configured.Subject, Scopes: configured.Scopes, Claims: configured.Claims}, nil
+		}
+	}
+	return nil, errors.New("invalid API key")
+}
+
+// jwtAuthenticator authenticates requests by the JWT bearer token in the
+// Authorization header, verified against the keys of a JWKS file.
+type jwtAuthenticator struct {
+	keys     map[string]jwk
+	issuer   string
+	audience string
+}
+
+// jwk is a verification key of a JWKS file.
+type jwk struct {
+	algorithm string
+	key       interface{}
+}
+
+func (a *jwtAuthenticator) authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, nil
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}), jwt.WithExpirationRequired()}
+	if a.issuer != "" {
+		options = append(options, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		options = append(options, jwt.WithAudience(a.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(header, "Bearer "), claims, a.key, options...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	subject, _ := claims.GetSubject()
+	return &Principal{Subject: subject, Scopes: tokenScopes(claims), Claims: claims}, nil
+}
+
+// key returns the key that verifies a token, selected by the key id in its header.
+func (a *jwtAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	key, ok := a.keys[id]
+	if !ok && id == "" && len(a.keys) == 1 {
+		for _, only := range a.keys {
+			key, ok = only, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	if key.algorithm != "" && key.algorithm != token.Method.Alg() {
+		return nil, fmt.Errorf("key %q is not used for %s", id, token.Method.Alg())
+	}
+	return key.key, nil
+}
+
+// tokenScopes returns the scopes of a token, from the space separated scope claim
+// or the scp claim.
+func tokenScopes(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	var scopes []string
+	if list, ok := claims["scp"].([]interface{}); ok {
+		for _, scope := range list {
+			if s, ok := scope.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
+
+// loadJWKS reads the keys of a JWKS file by key id.
+func loadJWKS(path string) (map[string]jwk, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS: %v", err)
+	}
+
+	var set struct {
+		Keys []struct {
+			ID        string `json:"kid"`
+			Type      string `json:"kty"`
+			Algorithm string `json:"alg"`
+			Curve     string `json:"crv"`
+			K         string `json:"k"`
+			N         string `json:"n"`
+			E         string `json:"e"`
+			X         string `json:"x"`
+			Y         string `json:"y"`
+		} `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS %s: %v", path, err)
+	}
+
+	keys := make(map[string]jwk)
+	for _, key := range set.Keys {
+		var parsed interface{}
+		switch key.Type {
+		case "oct":
+			parsed, err = base64.RawURLEncoding.DecodeString(key.K)
+		case "RSA":
+			parsed, err = rsaKey(key.N, key.E)
+		case "EC":
+			parsed, err = ecKey(key.Curve, key.X, key.Y)
+		default:
+			err = fmt.Errorf("unsupported key type %q", key.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS %s: key %q: %v", path, key.ID, err)
+		}
+		keys[key.ID] = jwk{algorithm: key.Algorithm, key: parsed}
+	}
+	return keys, nil
+}
+
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}, nil
+}
+
+func ecKey(curve, x, y string) (*ecdsa.PublicKey, error) {
+	if curve != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q", curve)
+	}
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return key, nil
+}
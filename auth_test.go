@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	auth, err := authenticate(Auth{APIKeys: []APIKey{{Key: "secret", Subject: "reporting", Scopes: []string{"pii:read"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var principal *Principal
+	handler := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = principalFromContext(r.Context())
+	}))
+
+	status, _ := authenticated(handler, apiKeyHeader, "secret")
+	if status != http.StatusOK || principal.Subject != "reporting" || !principal.HasScope("pii:read") {
+		t.Fatalf("unexpected response %d for principal %+v", status, principal)
+	}
+
+	status, body := authenticated(handler, apiKeyHeader, "guess")
+	if status != http.StatusUnauthorized || errorCode(t, body) != "UNAUTHENTICATED" {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+
+	principal = nil
+	status, _ = authenticated(handler, "", "")
+	if status != http.StatusOK || principal != nil {
+		t.Fatalf("unexpected response %d for anonymous request with principal %+v", status, principal)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	secret := []byte("a shared secret of at least 32 bytes")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "hmac", "kty": "oct", "alg": "HS256", "k": encode(secret)},
+		{"kid": "rsa", "kty": "RSA", "alg": "RS256", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "alg": "ES256", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}})
+	path := filepath.Join(dir, "jwks.json")
+	err = ioutil.WriteFile(path, jwks, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := authenticate(Auth{Required: true, JWKS: path, Issuer: "https://issuer.example", Audience: "people"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var principal *Principal
+	handler := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = principalFromContext(r.Context())
+	}))
+
+	claims := jwt.MapClaims{"sub": "jaap", "iss": "https://issuer.example", "aud": "people", "scope": "people:read pii:read", "exp": time.Now().Add(time.Hour).Unix()}
+	for _, key := range []struct {
+		id     string
+		method jwt.SigningMethod
+		key    interface{}
+	}{
+		{"hmac", jwt.SigningMethodHS256, secret},
+		{"rsa", jwt.SigningMethodRS256, rsaKey},
+		{"ec", jwt.SigningMethodES256, ecKey},
+	} {
+		token := jwt.NewWithClaims(key.method, claims)
+		token.Header["kid"] = key.id
+		signed, err := token.SignedString(key.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		principal = nil
+		status, body := authenticated(handler, "Authorization", "Bearer "+signed)
+		if status != http.StatusOK || principal.Subject != "jaap" || !principal.HasScope("pii:read") {
+			t.Fatalf("%s: unexpected response %d for principal %+v: %s", key.id, status, principal, body)
+		}
+	}
+
+	for name, claims := range map[string]jwt.MapClaims{
+		"expired":        {"sub": "jaap", "iss": "https://issuer.example", "aud": "people", "exp": time.Now().Add(-time.Hour).Unix()},
+		"wrong audience": {"sub": "jaap", "iss": "https://issuer.example", "aud": "other", "exp": time.Now().Add(time.Hour).Unix()},
+		"no expiry":      {"sub": "jaap", "iss": "https://issuer.example", "aud": "people"},
+	} {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = "hmac"
+		signed, err := token.SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, body := authenticated(handler, "Authorization", "Bearer "+signed)
+		if status != http.StatusUnauthorized || errorCode(t, body) != "UNAUTHENTICATED" {
+			t.Fatalf("%s: unexpected response %d: %s", name, status, body)
+		}
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "rsa"
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := authenticated(handler, "Authorization", "Bearer "+signed)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("token signed with the wrong algorithm for its key: unexpected response %d: %s", status, body)
+	}
+
+	status, body = authenticated(handler, "", "")
+	if status != http.StatusUnauthorized || errorCode(t, body) != "UNAUTHENTICATED" {
+		t.Fatalf("anonymous request: unexpected response %d: %s", status, body)
+	}
+}
+
+func authenticated(handler http.Handler, header, value string) (int, string) {
+	request := httptest.NewRequest(http.MethodPost, "/query", nil)
+	if header != "" {
+		request.Header.Set(header, value)
+	}
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response.Code, response.Body.String()
+}
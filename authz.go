@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/graphql-go/graphql"
+)
+
+// personScopes holds the scopes that callers need to read the fields of a person,
+// by the dotted path of the field.
+var personScopes = fieldOptions(&models.Person{}, models.E_Auth)
+
+// authorizing returns the caller of a request whose access to fields is checked,
+// which is nil for anonymous callers. Fields aren't checked when the server has
+// no credentials configured, nor for the query command.
+func authorizing(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// authorize returns an error when the caller isn't allowed to read the field at path.
+func authorize(ctx context.Context, path string) error {
+	scope, ok := personScopes[path]
+	if !ok {
+		return nil
+	}
+	principal, checked := authorizing(ctx)
+	if !checked || principal.HasScope(scope) {
+		return nil
+	}
+	return &forbiddenError{path: path, scope: scope}
+}
+
+// forbiddenError is the error of a field the caller isn't allowed to read, which
+// resolves to null.
+type forbiddenError struct {
+	path  string
+	scope string
+}
+
+func (e *forbiddenError) Error() string {
+	return fmt.Sprintf("not allowed to read %s, which requires the scope %s", e.path, e.scope)
+}
+
+func (e *forbiddenError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "FORBIDDEN", "scope": e.scope}
+}
+
+// guard resolves the field at path when the caller is allowed to read it, masks it
+// when the role of the caller has a masking policy and fails otherwise.
+func guard(p graphql.ResolveParams, path string, resolve graphql.FieldResolveFn) (interface{}, error) {
+	err := authorize(p.Context, path)
+	if err == nil {
+		return resolve(p)
+	}
+	policy := maskingPolicy(p.Context)
+	if policy == "" {
+		return nil, err
+	}
+
+	value, err := resolve(p)
+	if err != nil || value == nil {
+		return value, err
+	}
+	// computed values that aren't strings, like the country code of a phone number,
+	// can't be masked like the field they are computed from, so they are dropped
+	masked, ok := value.(string)
+	if !ok {
+		return nil, nil
+	}
+	return maskField(policy, path, masked), nil
+}
+
+// authorizeFields checks the scopes of the fields of an object, which holds the
+// person's fields at the given path.
+func authorizeFields(object *graphql.Object, prefix string) {
+	wrapResolvers(object, func(name string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+		path := prefix + name
+		// fields computed from another field are read like it
+		if source, ok := phoneFields[path]; ok {
+			path = source
+		}
+		if _, ok := personScopes[path]; !ok {
+			return resolve
+		}
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			return guard(p, path, resolve)
+		}
+	})
+}
+
+// authorizeChanges checks the scopes of the fields in the changes of a person, so
+// the old and new values don't reveal what the fields hide.
+func authorizeChanges(object *graphql.Object) {
+	wrapResolvers(object, func(name string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+		if name == "path" {
+			return resolve
+		}
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			change, _ := p.Source.(models.Change)
+			return guard(p, change.Path, resolve)
+		}
+	})
+}
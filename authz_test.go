@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFieldScopes(t *testing.T) {
+	expected := map[string]string{"email": "pii:read", "phone.number": "pii:read"}
+	if !reflect.DeepEqual(personScopes, expected) {
+		t.Fatalf("unexpected scopes %v, expected %v", personScopes, expected)
+	}
+}
+
+func TestFieldAuthorization(t *testing.T) {
+	auth, err := authenticate(Auth{APIKeys: []APIKey{
+		{Key: "support", Subject: "support"},
+		{Key: "reporting", Subject: "reporting", Scopes: []string{"pii:read"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth(queryHandler(newFileStore("data.bin"), defaultConfig(), nil))
+
+	query := func(key string) (int, string) {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person { name email phone { number type } } }"}`))
+		if key != "" {
+			request.Header.Set(apiKeyHeader, key)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response.Code, response.Body.String()
+	}
+
+	status, body := query("reporting")
+	if status != http.StatusOK || body != `{"person":{"email":"jaap@joosten","name":"Jaap Joosten","phone":{"number":"053218622189","type":"HOME"}}}`+"\n" {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+
+	for _, key := range []string{"support", ""} {
+		status, body = query(key)
+		var response struct {
+			Data   map[string]interface{}
+			Errors []struct {
+				Path       []interface{}
+				Extensions map[string]interface{}
+			}
+		}
+		err = json.Unmarshal([]byte(body), &response)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("unexpected response %d: %s", status, body)
+		}
+		person := response.Data["person"].(map[string]interface{})
+		if person["name"] != "Jaap Joosten" || person["email"] != nil || person["phone"].(map[string]interface{})["number"] != nil {
+			t.Fatalf("unexpected data for %q: %s", key, body)
+		}
+		if len(response.Errors) != 2 {
+			t.Fatalf("unexpected errors for %q: %s", key, body)
+		}
+		for _, e := range response.Errors {
+			if e.Extensions["code"] != "FORBIDDEN" || e.Extensions["scope"] != "pii:read" || len(e.Path) < 2 {
+				t.Fatalf("unexpected error for %q: %s", key, body)
+			}
+		}
+	}
+}
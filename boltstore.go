@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+var (
+	peopleBucket  = []byte("people")
+	historyBucket = []byte("history")
+)
+
+const (
+	historyPut    = 0
+	historyDelete = 1
+)
+
+// boltStore keeps every person as a separate protobuf value in a bbolt database,
+// keyed by id. Every version of a person is kept in the history bucket, keyed by
+// id and sequence number.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(peopleBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open store: %v", err)
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Person(id int32) (*models.Person, error) {
+	var person *models.Person
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(peopleBucket).Get(personKey(id))
+		if data == nil {
+			return nil
+		}
+		person = &models.Person{}
+		return unmarshalValue(data, valueData(peopleBucket, personKey(id)), person)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read person %d: %v", id, err)
+	}
+	return person, nil
+}
+
+func (s *boltStore) ForEach(fn func(person *models.Person) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(peopleBucket).ForEach(func(key, data []byte) error {
+			person := &models.Person{}
+			err := unmarshalValue(data, valueData(peopleBucket, key), person)
+			if err != nil {
+				return fmt.Errorf("failed to read person %d: %v", int32(binary.BigEndian.Uint32(key)), err)
+			}
+			return fn(person)
+		})
+	})
+}
+
+func (s *boltStore) Put(people ...*models.Person) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(peopleBucket)
+		for _, person := range people {
+			data, err := proto.Marshal(person)
+			var sealed []byte
+			if err == nil {
+				sealed, err = sealValue(data, valueData(peopleBucket, personKey(person.Id)))
+			}
+			if err == nil {
+				err = bucket.Put(personKey(person.Id), sealed)
+			}
+			if err == nil {
+				err = putVersion(tx, person.Id, now, historyPut, data)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write person %d: %v", person.Id, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Delete(id int32) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(peopleBucket)
+		if bucket.Get(personKey(id)) == nil {
+			return nil
+		}
+
+		err := bucket.Delete(personKey(id))
+		if err != nil {
+			return err
+		}
+		return putVersion(tx, id, now, historyDelete, nil)
+	})
+}
+
+func (s *boltStore) History(id int32) ([]Version, error) {
+	var versions []Version
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := personKey(id)
+		cursor := tx.Bucket(historyBucket).Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			if len(value) < 9 {
+				return fmt.Errorf("invalid version %x", key)
+			}
+
+			version := Version{
+				Seq:  binary.BigEndian.Uint64(key[len(prefix):]),
+				Time: time.Unix(0, int64(binary.BigEndian.Uint64(value))),
+			}
+			if value[8] == historyPut {
+				version.Person = &models.Person{}
+				err := unmarshalValue(value[9:], valueData(historyBucket, key), version.Person)
+				if err != nil {
+					return fmt.Errorf("invalid version %x: %v", key, err)
+				}
+			}
+
+			// newest first
+			versions = append([]Version{version}, versions...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of person %d: %v", id, err)
+	}
+	return versions, nil
+}
+
+// Rekey encrypts the people and their versions again with the current key.
+func (s *boltStore) Rekey() (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{peopleBucket, historyBucket} {
+			// the history values start with the time and the kind of change
+			prefix := 0
+			if bytes.Equal(name, historyBucket) {
+				prefix = 9
+			}
+
+			bucket := tx.Bucket(name)
+			values := make(map[string][]byte)
+			err := bucket.ForEach(func(key, value []byte) error {
+				if len(value) <= prefix {
+					return nil
+				}
+				// plain values are encrypted for the first time
+				additional := valueData(name, key)
+				data := value[prefix:]
+				var err error
+				if bytes.HasPrefix(data, []byte(encryptionMagic)) {
+					data, err = openValue(data, additional)
+				}
+				if err == nil {
+					data, err = sealValue(data, additional)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to encrypt %s %x: %v", name, key, err)
+				}
+				values[string(key)] = append(append([]byte(nil), value[:prefix]...), data...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for key, value := range values {
+				err = bucket.Put([]byte(key), value)
+				if err != nil {
+					return err
+				}
+			}
+			if prefix == 0 {
+				count = len(values)
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// unmarshalValue decodes a stored person, which is decrypted when it is encrypted.
+func unmarshalValue(value, additional []byte, person *models.Person) error {
+	data, err := openValue(value, additional)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, person)
+}
+
+func personKey(id int32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(id))
+	return key
+}
+
+// putVersion adds a version to the history of a person. The value holds the
+// time, the kind of change and the person as it was stored, encrypted when a
+// keyfile is configured.
+func putVersion(tx *bolt.Tx, id int32, at time.Time, kind byte, data []byte) error {
+	bucket := tx.Bucket(historyBucket)
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint32(key, uint32(id))
+	binary.BigEndian.PutUint64(key[4:], seq)
+	if data != nil {
+		data, err = sealValue(data, valueData(historyBucket, key))
+		if err != nil {
+			return err
+		}
+	}
+
+	value := make([]byte, 9, 9+len(data))
+	binary.BigEndian.PutUint64(value, uint64(at.UnixNano()))
+	value[8] = kind
+	value = append(value, data...)
+
+	return bucket.Put(key, value)
+}
+
+// migrateCommand imports the people of a data file into a bolt store.
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "data.bin", "data file to import")
+	to := flags.String("to", "people.db", "bolt database to import into")
+	keys := addDataFlags(flags)
+	region := addPhoneRegionFlag(flags)
+	flags.Parse(args)
+
+	err := keys.use()
+	if err == nil {
+		err = usePhoneRegion(*region)
+	}
+	if err != nil {
+		return err
+	}
+	var people []*models.Person
+	err = readData(context.Background(), *from, true, func(person *models.Person) error {
+		err := normalizePerson(person)
+		if err != nil {
+			return fmt.Errorf("failed to migrate person %d: %v", person.Id, err)
+		}
+		people = append(people, person)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	store, err := openBoltStore(*to)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// all people are imported in one transaction, so a failed migration leaves no partial data
+	err = store.Put(people...)
+	if err != nil {
+		return fmt.Errorf("failed to migrate data: %v", err)
+	}
+
+	log.Printf("migrated %d people from %s to %s", len(people), *from, *to)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"container/list"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"sync"
+)
+
+// documentCacheSize is the number of parsed queries kept in the parse cache.
+const documentCacheSize = 256
+
+var schemaCache struct {
+	sync.Mutex
+	schema *graphql.Schema
+}
+
+// cachedSchema returns the schema, which is built on first use.
+func cachedSchema() (graphql.Schema, error) {
+	schemaCache.Lock()
+	defer schemaCache.Unlock()
+
+	observeCache("schema", schemaCache.schema != nil)
+	if schemaCache.schema != nil {
+		return *schemaCache.schema, nil
+	}
+
+	schema, err := queryScheme()
+	if err != nil {
+		return schema, err
+	}
+	authorizeFields(models.GraphQLPersonType, "")
+	authorizeFields(models.GraphQLPhoneNumberType, "phone.")
+	authorizeChanges(fieldChangeType)
+	auditFields(models.GraphQLPersonType, "")
+	auditFields(models.GraphQLPhoneNumberType, "phone.")
+	timeResolvers(models.GraphQLPersonType)
+	traceResolvers(models.GraphQLPersonType)
+	schemaCache.schema = &schema
+	return schema, nil
+}
+
+// documentCache keeps the parsed documents of the most recent queries, as clients
+// send the same queries over and over.
+type documentCache struct {
+	mu        sync.Mutex
+	size      int
+	order     *list.List
+	documents map[string]*list.Element
+}
+
+type cachedDocument struct {
+	query    string
+	document *ast.Document
+}
+
+var documents = newDocumentCache(documentCacheSize)
+
+func newDocumentCache(size int) *documentCache {
+	return &documentCache{size: size, order: list.New(), documents: make(map[string]*list.Element)}
+}
+
+// parse returns the parsed document of a query. Documents are only read after
+// parsing, so they are shared by the requests that send the same query.
+func (c *documentCache) parse(query string) (*ast.Document, error) {
+	c.mu.Lock()
+	element, ok := c.documents[query]
+	if ok {
+		c.order.MoveToFront(element)
+	}
+	c.mu.Unlock()
+
+	observeCache("parse", ok)
+	if ok {
+		return element.Value.(*cachedDocument).document, nil
+	}
+
+	document, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.documents[query]; !ok {
+		c.documents[query] = c.order.PushFront(&cachedDocument{query: query, document: document})
+		if c.order.Len() > c.size {
+			oldest := c.order.Remove(c.order.Back()).(*cachedDocument)
+			delete(c.documents, oldest.query)
+		}
+	}
+	return document, nil
+}
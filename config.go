@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix is the prefix of the environment variables that configure the server.
+const envPrefix = "GQLPB_"
+
+// Config is the configuration of the server. Settings are read from, in order of
+// precedence, the command line flags, the environment, the configuration file and
+// the defaults.
+type Config struct {
+	Listen           string           `yaml:"listen" toml:"listen"`
+	Store            string           `yaml:"store" toml:"store"`
+	Data             string           `yaml:"data" toml:"data"`
+	ReadTimeout      time.Duration    `yaml:"readTimeout" toml:"readTimeout"`
+	WriteTimeout     time.Duration    `yaml:"writeTimeout" toml:"writeTimeout"`
+	IdleTimeout      time.Duration    `yaml:"idleTimeout" toml:"idleTimeout"`
+	ShutdownTimeout  time.Duration    `yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+	ShutdownDelay    time.Duration    `yaml:"shutdownDelay" toml:"shutdownDelay"`
+	MaxBodySize      int64            `yaml:"maxBodySize" toml:"maxBodySize"`
+	Features         Features         `yaml:"features" toml:"features"`
+	Tracing          Tracing          `yaml:"tracing" toml:"tracing"`
+	Logging          Logging          `yaml:"logging" toml:"logging"`
+	Limits           Limits           `yaml:"limits" toml:"limits"`
+	PersistedQueries PersistedQueries `yaml:"persistedQueries" toml:"persistedQueries"`
+	Auth             Auth             `yaml:"auth" toml:"auth"`
+	Masking          Masking          `yaml:"masking" toml:"masking"`
+	Policies         Policies         `yaml:"policies" toml:"policies"`
+	Tenancy          Tenancy          `yaml:"tenancy" toml:"tenancy"`
+	RateLimits       RateLimits       `yaml:"rateLimits" toml:"rateLimits"`
+	Audit            Audit            `yaml:"audit" toml:"audit"`
+	Encryption       Encryption       `yaml:"encryption" toml:"encryption"`
+	Signing          Signing          `yaml:"signing" toml:"signing"`
+	Phone            Phone            `yaml:"phone" toml:"phone"`
+	Retention        Retention        `yaml:"retention" toml:"retention"`
+}
+
+// Features are the parts of the API that can be switched off.
+type Features struct {
+	// History enables the asOf argument and the history and changes fields.
+	History bool `yaml:"history" toml:"history"`
+	// Introspection allows queries on __schema and __type.
+	Introspection bool `yaml:"introspection" toml:"introspection"`
+}
+
+// Tracing configures the export of OpenTelemetry spans.
+type Tracing struct {
+	// Exporter is stdout, otlp or empty to not export spans.
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	// Endpoint is the URL of the OTLP/HTTP endpoint, by default taken from OTEL_EXPORTER_OTLP_ENDPOINT.
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// Resolvers adds a span for every resolved field.
+	Resolvers bool `yaml:"resolvers" toml:"resolvers"`
+}
+
+// Logging configures the access log of queries.
+type Logging struct {
+	// Access writes a JSON line to stderr for every query.
+	Access bool `yaml:"access" toml:"access"`
+	// Variables is how the variables of a query are logged: omit, redact, mask or full.
+	Variables string `yaml:"variables" toml:"variables"`
+	// PII are the comma separated paths of the fields that are redacted from logged variables.
+	PII string `yaml:"pii" toml:"pii"`
+}
+
+// Limits are the limits on the complexity of queries. Zero is unlimited.
+type Limits struct {
+	MaxDepth      int64 `yaml:"maxDepth" toml:"maxDepth"`
+	MaxAliases    int64 `yaml:"maxAliases" toml:"maxAliases"`
+	MaxRootFields int64 `yaml:"maxRootFields" toml:"maxRootFields"`
+	MaxCost       int64 `yaml:"maxCost" toml:"maxCost"`
+}
+
+// PersistedQueries configures the queries that clients send by hash.
+type PersistedQueries struct {
+	// Mode is apq to let clients register queries, strict to only execute the
+	// queries in the manifest or off.
+	Mode string `yaml:"mode" toml:"mode"`
+	// Manifest is a JSON file of queries by hash, loaded at startup.
+	Manifest string `yaml:"manifest" toml:"manifest"`
+	// CacheSize is the number of registered queries that are kept.
+	CacheSize int64 `yaml:"cacheSize" toml:"cacheSize"`
+}
+
+// Auth configures the authentication of queries.
+type Auth struct {
+	// Required rejects requests without credentials, which are anonymous otherwise.
+	Required bool `yaml:"required" toml:"required"`
+	// APIKeys are the static API keys, which are only read from the configuration file.
+	APIKeys []APIKey `yaml:"apiKeys" toml:"apiKeys"`
+	// JWKS is the JWKS file with the keys that verify JWT bearer tokens.
+	JWKS     string `yaml:"jwks" toml:"jwks"`
+	Issuer   string `yaml:"issuer" toml:"issuer"`
+	Audience string `yaml:"audience" toml:"audience"`
+}
+
+// APIKey is a static API key and the principal it authenticates.
+type APIKey struct {
+	Key     string                 `yaml:"key" toml:"key"`
+	Subject string                 `yaml:"subject" toml:"subject"`
+	Scopes  []string               `yaml:"scopes" toml:"scopes"`
+	Claims  map[string]interface{} `yaml:"claims" toml:"claims"`
+}
+
+// Masking configures how callers see the fields they aren't authorized for, when
+// the fields have a mask in models.proto.
+type Masking struct {
+	// Roles holds the masking policy, mask, hash or drop, by the role claim of the
+	// caller. Callers without a policy can't read the fields.
+	Roles map[string]string `yaml:"roles" toml:"roles"`
+	// HashKey is the secret that keys the hashes of the hash policy.
+	HashKey string `yaml:"hashKey" toml:"hashKey"`
+}
+
+// Policies are the row-level access policies on the people in the store.
+type Policies struct {
+	// Rules are expressions over the person and the caller. A caller only sees the
+	// people for which a rule holds; without rules all people are visible.
+	Rules []string `yaml:"rules" toml:"rules"`
+
+	// policy are the rules as they are compiled when the configuration is validated.
+	policy rowPolicy
+}
+
+// Tenancy configures the tenants, whose people are kept in a store per tenant at
+// the data path with {tenant} replaced by the tenant.
+type Tenancy struct {
+	// Tenants are the comma separated tenants. Without tenants the server has a single store.
+	Tenants string `yaml:"tenants" toml:"tenants"`
+	// Header is the request header that names the tenant.
+	Header string `yaml:"header" toml:"header"`
+	// Claim is the claim of the caller that names its tenant, which the header can't override.
+	Claim string `yaml:"claim" toml:"claim"`
+}
+
+// RateLimits are the limits on the requests and the query cost of every client,
+// which is the authenticated subject or else the IP address.
+type RateLimits struct {
+	// Default are the limits of clients without a tier.
+	Default RateTier `yaml:"default" toml:"default"`
+	// Tiers are the limits by the tier claim of the caller, which are only read
+	// from the configuration file.
+	Tiers map[string]RateTier `yaml:"tiers" toml:"tiers"`
+	// Claim is the claim of the caller that names its tier.
+	Claim string `yaml:"claim" toml:"claim"`
+}
+
+// RateTier are the token buckets of a client. Zero is unlimited, and a zero burst
+// is the rate of a minute.
+type RateTier struct {
+	RequestsPerMinute int64 `yaml:"requestsPerMinute" toml:"requestsPerMinute"`
+	Burst             int64 `yaml:"burst" toml:"burst"`
+	// CostPerMinute is the query cost, as computed for the cost limit, that a
+	// client can spend in a minute.
+	CostPerMinute int64 `yaml:"costPerMinute" toml:"costPerMinute"`
+	CostBurst     int64 `yaml:"costBurst" toml:"costBurst"`
+}
+
+// Audit configures the audit log of the people that are read and changed.
+type Audit struct {
+	// Log is the file the hash-chained audit records are appended to. Without a
+	// log nothing is audited.
+	Log string `yaml:"log" toml:"log"`
+}
+
+// Encryption configures the encryption of the stored people.
+type Encryption struct {
+	// Keyfile is the JSON file with the keys that encrypt the people, which are
+	// stored in plain protobuf without it.
+	Keyfile string `yaml:"keyfile" toml:"keyfile"`
+}
+
+// Signing configures the verification of signed data files.
+type Signing struct {
+	// Keys are the comma separated PEM files with the Ed25519 public keys that
+	// signed data files are verified with.
+	Keys string `yaml:"keys" toml:"keys"`
+	// Strict refuses data files that aren't signed.
+	Strict bool `yaml:"strict" toml:"strict"`
+}
+
+// Phone configures how phone numbers are normalized and formatted.
+type Phone struct {
+	// DefaultRegion is the ISO 3166 code of the region of numbers without a country
+	// calling code, which aren't normalized when it's empty.
+	DefaultRegion string `yaml:"defaultRegion" toml:"defaultRegion"`
+}
+
+// Retention limits the history that the wal store keeps when it compacts its log.
+// The current version of a person is always kept.
+type Retention struct {
+	// MaxVersions is the number of versions kept of every person, 0 keeps all.
+	MaxVersions int64 `yaml:"maxVersions" toml:"maxVersions"`
+	// MaxAge is how long a version is kept after it was replaced, 0 keeps it forever.
+	MaxAge time.Duration `yaml:"maxAge" toml:"maxAge"`
+}
+
+var allFeatures = Features{History: true, Introspection: true}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:           ":8080",
+		Store:            "file",
+		Data:             "data.bin",
+		ReadTimeout:      10 * time.Second,
+		WriteTimeout:     30 * time.Second,
+		IdleTimeout:      2 * time.Minute,
+		ShutdownTimeout:  15 * time.Second,
+		ShutdownDelay:    5 * time.Second,
+		MaxBodySize:      1 << 20,
+		Features:         allFeatures,
+		Logging:          Logging{Access: true, Variables: "redact", PII: strings.Join(maskedPaths(), ",")},
+		Limits:           Limits{MaxDepth: 10, MaxAliases: 30, MaxRootFields: 20, MaxCost: 1000},
+		PersistedQueries: PersistedQueries{Mode: "apq", CacheSize: 1000},
+		Tenancy:          Tenancy{Header: "X-Tenant-Id", Claim: "tenant"},
+		RateLimits:       RateLimits{Claim: "tier"},
+		Phone:            Phone{DefaultRegion: "NL"},
+	}
+}
+
+// setting is a configuration setting that can be set by a flag or environment variable.
+type setting struct {
+	flag  string
+	usage string
+	value func(config *Config) interface{}
+}
+
+var settings = []setting{
+	{"listen", "address the server listens on", func(c *Config) interface{} { return &c.Listen }},
+	{"store", "person store backend: file, bolt or wal", func(c *Config) interface{} { return &c.Store }},
+	{"data", "path of the person data", func(c *Config) interface{} { return &c.Data }},
+	{"read-timeout", "maximum duration for reading a request", func(c *Config) interface{} { return &c.ReadTimeout }},
+	{"write-timeout", "maximum duration for writing a response", func(c *Config) interface{} { return &c.WriteTimeout }},
+	{"idle-timeout", "maximum time to wait for the next request on a connection", func(c *Config) interface{} { return &c.IdleTimeout }},
+	{"shutdown-timeout", "maximum duration for draining requests on shutdown", func(c *Config) interface{} { return &c.ShutdownTimeout }},
+	{"shutdown-delay", "duration the server reports not ready on shutdown before it stops accepting connections", func(c *Config) interface{} { return &c.ShutdownDelay }},
+	{"max-body-size", "maximum size of a request body in bytes", func(c *Config) interface{} { return &c.MaxBodySize }},
+	{"features-history", "enable the history of people", func(c *Config) interface{} { return &c.Features.History }},
+	{"features-introspection", "allow introspection queries", func(c *Config) interface{} { return &c.Features.Introspection }},
+	{"tracing-exporter", "span exporter: stdout, otlp or empty", func(c *Config) interface{} { return &c.Tracing.Exporter }},
+	{"tracing-endpoint", "URL of the OTLP/HTTP endpoint", func(c *Config) interface{} { return &c.Tracing.Endpoint }},
+	{"tracing-resolvers", "add a span for every resolved field", func(c *Config) interface{} { return &c.Tracing.Resolvers }},
+	{"persisted-queries", "persisted queries: apq, strict or off", func(c *Config) interface{} { return &c.PersistedQueries.Mode }},
+	{"persisted-queries-manifest", "JSON file of persisted queries by hash", func(c *Config) interface{} { return &c.PersistedQueries.Manifest }},
+	{"persisted-queries-cache-size", "number of registered persisted queries that are kept", func(c *Config) interface{} { return &c.PersistedQueries.CacheSize }},
+	{"auth-required", "reject queries without credentials", func(c *Config) interface{} { return &c.Auth.Required }},
+	{"auth-jwks", "JWKS file with the keys that verify JWT bearer tokens", func(c *Config) interface{} { return &c.Auth.JWKS }},
+	{"auth-issuer", "required issuer of JWT bearer tokens", func(c *Config) interface{} { return &c.Auth.Issuer }},
+	{"auth-audience", "required audience of JWT bearer tokens", func(c *Config) interface{} { return &c.Auth.Audience }},
+	{"tenants", "comma separated tenants, whose stores are at the data path with {tenant} replaced", func(c *Config) interface{} { return &c.Tenancy.Tenants }},
+	{"tenant-header", "request header that names the tenant", func(c *Config) interface{} { return &c.Tenancy.Header }},
+	{"tenant-claim", "claim of the caller that names its tenant", func(c *Config) interface{} { return &c.Tenancy.Claim }},
+	{"rate-limit-requests", "requests per minute of a client, 0 is unlimited", func(c *Config) interface{} { return &c.RateLimits.Default.RequestsPerMinute }},
+	{"rate-limit-burst", "burst of requests of a client, 0 is a minute of requests", func(c *Config) interface{} { return &c.RateLimits.Default.Burst }},
+	{"rate-limit-cost", "query cost per minute of a client, 0 is unlimited", func(c *Config) interface{} { return &c.RateLimits.Default.CostPerMinute }},
+	{"rate-limit-cost-burst", "burst of query cost of a client, 0 is a minute of cost", func(c *Config) interface{} { return &c.RateLimits.Default.CostBurst }},
+	{"rate-limit-tier-claim", "claim of the caller that names its rate limit tier", func(c *Config) interface{} { return &c.RateLimits.Claim }},
+	{"encryption-keyfile", "keyfile with the keys that encrypt the stored people", func(c *Config) interface{} { return &c.Encryption.Keyfile }},
+	{"signing-keys", "comma separated PEM files with the public keys that verify signed data files", func(c *Config) interface{} { return &c.Signing.Keys }},
+	{"signing-strict", "refuse data files that aren't signed", func(c *Config) interface{} { return &c.Signing.Strict }},
+	{"phone-default-region", "region of phone numbers without a country calling code", func(c *Config) interface{} { return &c.Phone.DefaultRegion }},
+	{"retention-max-versions", "versions of a person kept in the history of the wal store, 0 keeps all", func(c *Config) interface{} { return &c.Retention.MaxVersions }},
+	{"retention-max-age", "time a replaced version is kept in the history of the wal store, 0 keeps it forever", func(c *Config) interface{} { return &c.Retention.MaxAge }},
+	{"masking-hash-key", "secret that keys the hashes of the hash masking policy", func(c *Config) interface{} { return &c.Masking.HashKey }},
+	{"audit-log", "file the audit records of reads and changes of people are appended to", func(c *Config) interface{} { return &c.Audit.Log }},
+	{"log-access", "write an access log line for every query", func(c *Config) interface{} { return &c.Logging.Access }},
+	{"log-variables", "how query variables are logged: omit, redact, mask or full", func(c *Config) interface{} { return &c.Logging.Variables }},
+	{"limits-max-depth", "maximum depth of a query, 0 is unlimited", func(c *Config) interface{} { return &c.Limits.MaxDepth }},
+	{"limits-max-aliases", "maximum number of aliases in a query, 0 is unlimited", func(c *Config) interface{} { return &c.Limits.MaxAliases }},
+	{"limits-max-root-fields", "maximum number of root fields in a query, 0 is unlimited", func(c *Config) interface{} { return &c.Limits.MaxRootFields }},
+	{"limits-max-cost", "maximum cost of a query, 0 is unlimited", func(c *Config) interface{} { return &c.Limits.MaxCost }},
+	{"log-pii", "comma separated paths of fields redacted from logged variables", func(c *Config) interface{} { return &c.Logging.PII }},
+}
+
+// loadConfig reads the configuration from the flags in args, the environment and
+// the configuration file given by the config flag or GQLPB_CONFIG.
+func loadConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	config := defaultConfig()
+
+	// the flags are parsed into a separate config, so only the flags that are set override the others
+	flagged := defaultConfig()
+	file := flags.String("config", os.Getenv(envPrefix+"CONFIG"), "configuration file, in YAML or TOML")
+	for _, s := range settings {
+		switch value := s.value(&flagged).(type) {
+		case *string:
+			flags.StringVar(value, s.flag, *value, s.usage)
+		case *time.Duration:
+			flags.DurationVar(value, s.flag, *value, s.usage)
+		case *int64:
+			flags.Int64Var(value, s.flag, *value, s.usage)
+		case *bool:
+			flags.BoolVar(value, s.flag, *value, s.usage)
+		}
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return config, err
+	}
+
+	if *file != "" {
+		err = readConfigFile(*file, &config)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	for _, s := range settings {
+		name := envName(s.flag)
+		if value, ok := os.LookupEnv(name); ok {
+			err = setValue(s.value(&config), value)
+			if err != nil {
+				return config, fmt.Errorf("invalid configuration: %s: %v", name, err)
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				setValue(s.value(&config), f.Value.String())
+			}
+		}
+	})
+
+	return config, config.validate()
+}
+
+// configValue returns a setting of the configuration file in GQLPB_CONFIG and the
+// environment, for the commands that don't load the configuration. Only the file
+// is parsed; the configuration isn't validated.
+func configValue(name string) (string, error) {
+	config := defaultConfig()
+	if file := os.Getenv(envPrefix + "CONFIG"); file != "" {
+		err := readConfigFile(file, &config)
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, s := range settings {
+		if s.flag != name {
+			continue
+		}
+		if value, ok := os.LookupEnv(envName(name)); ok {
+			return value, nil
+		}
+		return fmt.Sprint(reflect.ValueOf(s.value(&config)).Elem()), nil
+	}
+	return "", fmt.Errorf("unknown setting %s", name)
+}
+
+// envName returns the environment variable of a setting.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+func readConfigFile(path string, config *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, config)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(data), config)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown settings %v", meta.Undecoded())
+		}
+	default:
+		err = fmt.Errorf("unknown format, expected .yaml or .toml")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read configuration %s: %v", path, err)
+	}
+	return nil
+}
+
+func setValue(target interface{}, value string) error {
+	var err error
+	switch target := target.(type) {
+	case *string:
+		*target = value
+	case *time.Duration:
+		*target, err = time.ParseDuration(value)
+	case *int64:
+		*target, err = strconv.ParseInt(value, 10, 64)
+	case *bool:
+		*target, err = strconv.ParseBool(value)
+	}
+	return err
+}
+
+// validate checks the configuration and compiles the policy rules.
+func (c *Config) validate() error {
+	var problems []string
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen address %q: %v", c.Listen, err))
+	}
+	switch c.Store {
+	case "file", "bolt", "wal":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown store backend %q", c.Store))
+	}
+	if c.Data == "" {
+		problems = append(problems, "data path is empty")
+	}
+	if c.Signing.Strict && c.Signing.Keys == "" {
+		problems = append(problems, "strict signing needs public keys")
+	}
+	if c.Signing.Strict && c.Store != "file" {
+		problems = append(problems, fmt.Sprintf("store backend %s doesn't read signed data files", c.Store))
+	}
+	if c.Phone.DefaultRegion != "" && findPhoneRegion(c.Phone.DefaultRegion) == nil {
+		problems = append(problems, fmt.Sprintf("unsupported phone region %q", c.Phone.DefaultRegion))
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 || c.ShutdownTimeout < 0 || c.ShutdownDelay < 0 {
+		problems = append(problems, "timeouts must not be negative")
+	}
+	if c.Limits.MaxDepth < 0 || c.Limits.MaxAliases < 0 || c.Limits.MaxRootFields < 0 || c.Limits.MaxCost < 0 {
+		problems = append(problems, "limits must not be negative")
+	}
+	for name, tier := range c.RateLimits.Tiers {
+		if name == defaultTier {
+			problems = append(problems, fmt.Sprintf("rate limit tier %s is reserved", name))
+		}
+		if !tier.valid() {
+			problems = append(problems, fmt.Sprintf("rate limits of tier %s must not be negative", name))
+		}
+	}
+	if !c.RateLimits.Default.valid() {
+		problems = append(problems, "rate limits must not be negative")
+	}
+	if c.Retention.MaxVersions < 0 || c.Retention.MaxAge < 0 {
+		problems = append(problems, "retention must not be negative")
+	}
+	if c.MaxBodySize <= 0 {
+		problems = append(problems, "max body size must be positive")
+	}
+	switch c.PersistedQueries.Mode {
+	case "apq", "off":
+	case "strict":
+		if c.PersistedQueries.Manifest == "" {
+			problems = append(problems, "strict persisted queries need a manifest")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown persisted queries mode %q", c.PersistedQueries.Mode))
+	}
+	if c.PersistedQueries.CacheSize <= 0 {
+		problems = append(problems, "persisted queries cache size must be positive")
+	}
+	for i, key := range c.Auth.APIKeys {
+		if key.Key == "" || key.Subject == "" {
+			problems = append(problems, fmt.Sprintf("API key %d needs a key and a subject", i+1))
+		}
+	}
+	if c.Auth.Required && len(c.Auth.APIKeys) == 0 && c.Auth.JWKS == "" {
+		problems = append(problems, "authentication is required but no API keys or JWKS are configured")
+	}
+	if c.Masking.HashKey != "" && len(c.Masking.HashKey) < minHashKeySize {
+		problems = append(problems, fmt.Sprintf("masking hash key must have at least %d bytes", minHashKeySize))
+	}
+	if c.Audit.Log != "" && c.Masking.HashKey == "" {
+		problems = append(problems, "the audit log needs a masking hash key to hash the changed fields")
+	}
+	for role, policy := range c.Masking.Roles {
+		switch policy {
+		case hashPolicy:
+			if c.Masking.HashKey == "" {
+				problems = append(problems, fmt.Sprintf("masking policy hash for role %q needs a masking hash key", role))
+			}
+		case maskPolicy, dropPolicy:
+		default:
+			problems = append(problems, fmt.Sprintf("unknown masking policy %q for role %q", policy, role))
+		}
+	}
+	if c.Tenancy.Tenants != "" {
+		for _, tenant := range strings.Split(c.Tenancy.Tenants, ",") {
+			if _, err := tenantPath(c.Data, strings.TrimSpace(tenant)); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if c.Tenancy.Header == "" && c.Tenancy.Claim == "" {
+			problems = append(problems, "tenants need a tenant header or claim")
+		}
+	} else if strings.Contains(c.Data, tenantPlaceholder) {
+		problems = append(problems, fmt.Sprintf("data path %s has %s but no tenants are configured", c.Data, tenantPlaceholder))
+	}
+	if len(c.Policies.Rules) > 0 {
+		policy, err := compilePolicy(c.Policies.Rules)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		c.Policies.policy = policy
+		// callers aren't checked without credentials, so the rules wouldn't hold anyone back
+		if !authConfigured(c.Auth) {
+			problems = append(problems, "policy rules need API keys or a JWKS")
+		}
+	}
+	switch c.Logging.Variables {
+	case "omit", "redact", "mask", "full":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown variables logging %q", c.Logging.Variables))
+	}
+	switch c.Tracing.Exporter {
+	case "", "stdout", "otlp":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown tracing exporter %q", c.Tracing.Exporter))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+type featuresKey struct{}
+
+func withFeatures(ctx context.Context, features Features) context.Context {
+	return context.WithValue(ctx, featuresKey{}, features)
+}
+
+// featuresFromContext returns the features enabled for a query. All features are
+// enabled for queries that don't run in the server, like the query command.
+func featuresFromContext(ctx context.Context) Features {
+	if features, ok := ctx.Value(featuresKey{}).(Features); ok {
+		return features
+	}
+	return allFeatures
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.yaml": "listen: :9000\nstore: bolt\nreadTimeout: 5s\nmaxBodySize: 2048\nfeatures:\n  history: false\n",
+		"config.toml": "listen = \":9000\"\nstore = \"bolt\"\nreadTimeout = \"5s\"\nmaxBodySize = 2048\n[features]\nhistory = false\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Setenv("GQLPB_STORE", "wal")
+		os.Setenv("GQLPB_WRITE_TIMEOUT", "1m")
+		config, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path, "-store", "file"})
+		os.Unsetenv("GQLPB_STORE")
+		os.Unsetenv("GQLPB_WRITE_TIMEOUT")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		expected := defaultConfig()
+		expected.Listen = ":9000"
+		expected.ReadTimeout = 5 * time.Second
+		expected.WriteTimeout = time.Minute
+		expected.MaxBodySize = 2048
+		expected.Features.History = false
+		if !reflect.DeepEqual(config, expected) {
+			t.Fatalf("%s: unexpected configuration %+v, expected %+v", name, config, expected)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	err := ioutil.WriteFile(path, []byte("listen: nowhere\nmaxBodySize: 0\nmasking:\n  roles:\n    analytics: hash\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path, "-store", "sql", "-audit-log", "audit.log"})
+	if err == nil {
+		t.Fatal("expected invalid configuration")
+	}
+	for _, problem := range []string{"listen address", "unknown store backend \"sql\"", "max body size", "needs a masking hash key", "audit log needs a masking hash key"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("error %q doesn't report %q", err, problem)
+		}
+	}
+
+	err = ioutil.WriteFile(path, []byte("listen: :8080\ntimeout: 5s\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path})
+	if err == nil {
+		t.Fatal("expected unknown setting to be rejected")
+	}
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	ctx := withFeatures(context.Background(), Features{})
+	store := newFileStore("data.bin")
+
+	for _, query := range []string{
+		`{ __schema { queryType { name } } }`,
+		`{ ...schema } fragment schema on Query { __type(name: "Person") { name } }`,
+		`{ person { history { seq } } }`,
+		`{ person(asOf: "2019-10-01T12:00:00Z") { name } }`,
+	} {
+		_, err := execute(ctx, queryRequest{Query: query}, store)
+		if err == nil {
+			t.Fatalf("query %s succeeded with features disabled", query)
+		}
+	}
+
+	_, err := execute(ctx, queryRequest{Query: `{ person { __typename name } }`}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/graphql-go/graphql"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var fieldChangeType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "FieldChange",
+	Fields: graphql.Fields{
+		"path": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(models.Change).Path, nil
+			},
+		},
+		"old": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return fmt.Sprint(p.Source.(models.Change).Old), nil
+			},
+		},
+		"new": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return fmt.Sprint(p.Source.(models.Change).New), nil
+			},
+		},
+	},
+})
+
+func init() {
+	addField(models.GraphQLPersonType, "changes", &graphql.Field{
+		Type:        graphql.NewList(fieldChangeType),
+		Description: "The fields that changed since the given time.",
+		Args: graphql.FieldConfigArgument{
+			"since": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.DateTime)},
+		},
+		Resolve: resolveChanges,
+	})
+}
+
+func resolveChanges(p graphql.ResolveParams) (interface{}, error) {
+	if !featuresFromContext(p.Context).History {
+		return nil, errHistoryDisabled
+	}
+	person, _ := sourcePerson(p.Source)
+	since, ok := p.Args["since"].(time.Time)
+	if person == nil || !ok {
+		return nil, fmt.Errorf("field changes not resolved")
+	}
+
+	version, err := versionAsOf(storeFromContext(p.Context), person.Id, since)
+	if err != nil {
+		return nil, err
+	}
+
+	var earlier *models.Person
+	if version != nil {
+		earlier = version.Person
+	}
+
+	changes := models.Diff(earlier, person)
+	if changes == nil {
+		changes = []models.Change{}
+	}
+	return changes, nil
+}
+
+// diffCommand prints the changes between the people in two data files.
+func diffCommand(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	keys := addDataFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: diff [-keyfile keys.json] [-signing-keys public.pem] old.bin new.bin")
+	}
+	err := keys.use()
+	if err != nil {
+		return err
+	}
+
+	old, err := peopleByID(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	new, err := peopleByID(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int32, 0, len(old)+len(new))
+	for id := range old {
+		ids = append(ids, id)
+	}
+	for id := range new {
+		if _, ok := old[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		changes := models.Diff(old[id], new[id])
+		switch {
+		case old[id] == nil:
+			fmt.Printf("person %d added\n", id)
+		case new[id] == nil:
+			fmt.Printf("person %d removed\n", id)
+			continue
+		case len(changes) > 0:
+			fmt.Printf("person %d changed\n", id)
+		}
+
+		for _, change := range changes {
+			fmt.Printf("  %s: %s -> %s\n", change.Path, formatValue(change.Old), formatValue(change.New))
+		}
+	}
+	return nil
+}
+
+// peopleByID reads the people in a data file, which may be encrypted or not, so
+// data can be compared before and after it is encrypted.
+func peopleByID(path string) (map[int32]*models.Person, error) {
+	people := make(map[int32]*models.Person)
+	err := readData(context.Background(), path, true, func(person *models.Person) error {
+		people[person.Id] = person
+		return nil
+	})
+	return people, err
+}
+
+func formatValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(value)
+}
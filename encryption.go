@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// encryptionMagic starts the header of encrypted data files and values.
+const encryptionMagic = "GQPBENC1"
+
+// dataKeys are the keys that encrypt the stored people, or nil when they are
+// stored in plain protobuf.
+var dataKeys *keyring
+
+var errNoKeyfile = errors.New("data is encrypted, but no keyfile is configured")
+
+var errPlainData = errors.New("data is not encrypted, but a keyfile is configured; encrypt it with rotate-keys")
+
+// keyring holds the key encryption keys by id. Data is encrypted with a fresh
+// data key, which is stored with the data wrapped by the current key.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// keyfile is the JSON file with the key encryption keys, as base64 encoded
+// AES-256 keys by id.
+type keyfile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// loadKeyring reads the keys in a keyfile.
+func loadKeyring(path string) (*keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %v", err)
+	}
+	var file keyfile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile %s: %v", path, err)
+	}
+
+	ring := &keyring{current: file.Current, keys: make(map[string]cipher.AEAD)}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("failed to read keyfile %s: key %s is not a base64 encoded 256-bit key", path, id)
+		}
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("failed to read keyfile %s: invalid key id %q", path, id)
+		}
+		ring.keys[id], err = newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keyfile %s: %v", path, err)
+		}
+	}
+	if _, ok := ring.keys[ring.current]; !ok {
+		return nil, fmt.Errorf("failed to read keyfile %s: current key %q not found", path, ring.current)
+	}
+	return ring, nil
+}
+
+// useKeyfile encrypts the stored people with the keys in the keyfile at path, or
+// stores them in plain protobuf when path is empty.
+func useKeyfile(path string) error {
+	if path == "" {
+		dataKeys = nil
+		return nil
+	}
+	ring, err := loadKeyring(path)
+	if err != nil {
+		return err
+	}
+	dataKeys = ring
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// envelope is the data key of an encrypted data file or value.
+type envelope struct {
+	keyID string
+	aead  cipher.AEAD
+	// size is the size of the header.
+	size int
+}
+
+// newEnvelope returns a fresh data key, wrapped by the current key, and the
+// header that holds it.
+func (k *keyring) newEnvelope() (*envelope, []byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create data key: %v", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create data key: %v", err)
+	}
+
+	wrapped, err := seal(k.keys[k.current], key, []byte(k.current))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	header := []byte(encryptionMagic)
+	header = binary.AppendUvarint(header, uint64(len(k.current)))
+	header = append(header, k.current...)
+	header = binary.AppendUvarint(header, uint64(len(wrapped)))
+	header = append(header, wrapped...)
+	return &envelope{keyID: k.current, aead: aead, size: len(header)}, header, nil
+}
+
+// openEnvelope reads the header of encrypted data, after the magic, and unwraps
+// its data key.
+func (k *keyring) openEnvelope(r *bufio.Reader) (*envelope, error) {
+	if k == nil {
+		return nil, errNoKeyfile
+	}
+	id, err := readField(r, 255)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %v", err)
+	}
+	wrapped, err := readField(r, 128)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %v", err)
+	}
+
+	kek, ok := k.keys[string(id)]
+	if !ok {
+		return nil, fmt.Errorf("data is encrypted with unknown key %q", id)
+	}
+	key, err := open(kek, wrapped, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of key %q: %v", id, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %v", err)
+	}
+	return &envelope{keyID: string(id), aead: aead, size: len(encryptionMagic) + fieldSize(id) + fieldSize(wrapped)}, nil
+}
+
+func readField(r *bufio.Reader, max uint64) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > max {
+		return nil, fmt.Errorf("field too large: %d bytes", size)
+	}
+	field := make([]byte, size)
+	_, err = io.ReadFull(r, field)
+	return field, err
+}
+
+// fieldSize returns the size of a length-prefixed field.
+func fieldSize(field []byte) int {
+	return len(binary.AppendUvarint(nil, uint64(len(field)))) + len(field)
+}
+
+// seal encrypts data with a random nonce, which it is prefixed with.
+func seal(aead cipher.AEAD, data, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, data, additional), nil
+}
+
+func open(aead cipher.AEAD, data, additional []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additional)
+}
+
+// recordData binds an encrypted record to its position in a data file, so records
+// can't be reordered.
+func recordData(index int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(index))
+}
+
+// endData binds the end of an encrypted data file to the number of records in it,
+// so records can't be cut off.
+func endData(count int) []byte {
+	return append([]byte("end"), recordData(count)...)
+}
+
+// valueData binds an encrypted value to the bucket and key it is stored under, so
+// values can't be moved to another person or version.
+func valueData(bucket, key []byte) []byte {
+	data := binary.AppendUvarint(nil, uint64(len(bucket)))
+	data = append(data, bucket...)
+	return append(data, key...)
+}
+
+// sealValue encrypts a stored value in an envelope of its own, bound to additional
+// data, or returns it as it is when the people are stored in plain protobuf.
+func sealValue(data, additional []byte) ([]byte, error) {
+	if dataKeys == nil {
+		return data, nil
+	}
+	envelope, header, err := dataKeys.newEnvelope()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(envelope.aead, data, additional)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+// openValue decrypts a stored value, which is returned as it is when it isn't
+// encrypted and no keyfile is configured.
+func openValue(data, additional []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptionMagic)) {
+		if dataKeys != nil {
+			return nil, errPlainData
+		}
+		return data, nil
+	}
+	r := bufio.NewReader(bytes.NewReader(data[len(encryptionMagic):]))
+	envelope, err := dataKeys.openEnvelope(r)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return open(envelope.aead, sealed, additional)
+}
+
+// rekeyer is a store that can encrypt its people again with the current key.
+type rekeyer interface {
+	// Rekey encrypts all stored data with the current key and returns the number
+	// of people.
+	Rekey() (int, error)
+}
+
+// rotateKeysCommand encrypts the data in a store with the current key of the
+// keyfile, after the key has been rotated or to encrypt plain data.
+func rotateKeysCommand(args []string) error {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	stores := addStoreFlags(flags)
+	flags.Parse(args)
+
+	if *stores.keyfile == "" {
+		return fmt.Errorf("usage: rotate-keys -keyfile keys.json [-store file|bolt] [-data path]")
+	}
+	store, err := stores.open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	rekeyed, ok := store.(rekeyer)
+	if !ok {
+		return fmt.Errorf("store backend %s doesn't support encryption", *stores.backend)
+	}
+	count, err := rekeyed.Rekey()
+	if err != nil {
+		return fmt.Errorf("failed to rotate keys: %v", err)
+	}
+	fmt.Printf("encrypted %d people with key %s\n", count, dataKeys.current)
+	return nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	bolt "go.etcd.io/bbolt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeKeyfile writes a keyfile with the given keys and current key.
+func writeKeyfile(t *testing.T, path string, keys map[string][]byte, current string) {
+	file := keyfile{Current: current, Keys: make(map[string]string)}
+	for id, key := range keys {
+		file.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	data, err := json.Marshal(file)
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptedDataFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer useKeyfile("")
+
+	keys := filepath.Join(dir, "keys.json")
+	writeKeyfile(t, keys, map[string][]byte{"k1": newKey(t)}, "k1")
+	err := useKeyfile(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "data.bin")
+	store := newFileStore(path)
+	err = store.Put(&models.Person{Id: 32, Name: "Jaap Joosten", Email: "jaap@joosten"}, &models.Person{Id: 33, Name: "Anna Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(encryptionMagic+"\x02k1")) || bytes.Contains(data, []byte("Joosten")) {
+		t.Fatalf("data not encrypted: %q", data)
+	}
+
+	person, err := store.Person(33)
+	if err != nil || person == nil || person.Name != "Anna Joosten" {
+		t.Fatalf("unexpected person %v, %v", person, err)
+	}
+
+	// inspect, diff and import decrypt the data
+	err = inspectCommand([]string{"-keyfile", keys, path})
+	if err == nil {
+		err = diffCommand([]string{"-keyfile", keys, "data.bin", path})
+	}
+	// the keys are loaded by the command before the file is read
+	imported := filepath.Join(dir, "imported.db")
+	useKeyfile("")
+	if err == nil {
+		err = importCommand([]string{"-keyfile", keys, "-format", "proto", "-store", "bolt", "-data", imported, path})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	importedStore, err := openBoltStore(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	person, err = importedStore.Person(32)
+	importedStore.Close()
+	if err != nil || person == nil || person.Name != "Jaap Joosten" {
+		t.Fatalf("unexpected imported person %v, %v", person, err)
+	}
+
+	// records can't be swapped or cut off
+	var records [][]byte
+	reader := newPersonReader(bytes.NewReader(data))
+	header := data[:reader.offset]
+	var start int64
+	for {
+		start = reader.offset
+		_, err := reader.NextRecord()
+		if err != nil {
+			break
+		}
+		records = append(records, data[start:reader.offset])
+	}
+	end := data[start:]
+	for _, tampered := range []struct {
+		name  string
+		parts [][]byte
+		err   string
+	}{
+		{"swapped", [][]byte{header, records[1], records[0], end}, "failed to decrypt"},
+		{"without end", [][]byte{header, records[0], records[1]}, "data truncated after record 2"},
+		{"cut off", [][]byte{header, records[0], end}, "invalid end of data after record 1"},
+		{"appended", [][]byte{header, records[0], records[1], end, records[0]}, "data after the end"},
+	} {
+		path := filepath.Join(dir, "tampered.bin")
+		err = ioutil.WriteFile(path, bytes.Join(tampered.parts, nil), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = newFileStore(path).ForEach(func(*models.Person) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), tampered.err) {
+			t.Fatalf("%s records read: %v", tampered.name, err)
+		}
+	}
+
+	writeKeyfile(t, keys, map[string][]byte{"k1": newKey(t)}, "k1")
+	err = useKeyfile(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Person(32)
+	if err == nil {
+		t.Fatal("data read with another key")
+	}
+
+	useKeyfile("")
+	_, err = store.Person(32)
+	if err == nil || !strings.Contains(err.Error(), errNoKeyfile.Error()) {
+		t.Fatalf("data read without a keyfile: %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer useKeyfile("")
+
+	k1, k2 := newKey(t), newKey(t)
+	keys := filepath.Join(dir, "keys.json")
+	for _, backend := range []string{"file", "bolt", "wal"} {
+		path := filepath.Join(dir, backend+".data")
+		writeKeyfile(t, keys, map[string][]byte{"k1": k1}, "k1")
+		err := useKeyfile(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := openStore(backend, path)
+		if err == nil {
+			err = store.Put(&models.Person{Id: 32, Name: "Jaap Joosten"})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+
+		writeKeyfile(t, keys, map[string][]byte{"k1": k1, "k2": k2}, "k2")
+		err = rotateKeysCommand([]string{"-store", backend, "-data", path, "-keyfile", keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the data is readable without the old key
+		writeKeyfile(t, keys, map[string][]byte{"k2": k2}, "k2")
+		err = useKeyfile(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err = openStore(backend, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		person, err := store.Person(32)
+		if err != nil || person == nil || person.Name != "Jaap Joosten" {
+			t.Fatalf("%s: unexpected person %v, %v", backend, person, err)
+		}
+		versions, err := store.History(32)
+		if err != nil || len(versions) != 1 {
+			t.Fatalf("%s: unexpected history %v, %v", backend, versions, err)
+		}
+		store.Close()
+	}
+}
+
+func TestEncryptedWAL(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer useKeyfile("")
+
+	keys := filepath.Join(dir, "keys.json")
+	writeKeyfile(t, keys, map[string][]byte{"k1": newKey(t)}, "k1")
+	err := useKeyfile(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "wal")
+	store, err := openWALStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(&models.Person{Id: 32, Name: "Jaap Joosten"}, &models.Person{Id: 33, Name: "Anna Joosten"})
+	if err == nil {
+		err = store.Compact()
+	}
+	if err == nil {
+		err = store.Put(&models.Person{Id: 32, Name: "Jaap de Vries"})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	for _, name := range []string{walLogFile, walSnapshotFile, walHistoryFile} {
+		data, err := ioutil.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 || bytes.Contains(data, []byte("Joosten")) || bytes.Contains(data, []byte("Vries")) {
+			t.Fatalf("%s not encrypted: %q", name, data)
+		}
+	}
+
+	store, err = openWALStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := storedNames(t, store); !reflect.DeepEqual(names, []string{"Jaap de Vries", "Anna Joosten"}) {
+		t.Fatalf("unexpected people %v", names)
+	}
+	versions, err := store.History(32)
+	if err != nil || len(versions) != 2 || versions[1].Person.Name != "Jaap Joosten" {
+		t.Fatalf("unexpected history %v, %v", versions, err)
+	}
+	store.Close()
+
+	// a record moved to another sequence number isn't decrypted
+	data, err := ioutil.ReadFile(filepath.Join(path, walHistoryFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(dir, "moved")
+	err = os.MkdirAll(moved, 0700)
+	if err == nil {
+		_, n := binary.Uvarint(data)
+		payload := append([]byte(nil), data[n:len(data)-4]...)
+		payload[0]++
+		frame := binary.AppendUvarint(nil, uint64(len(payload)))
+		frame = append(frame, payload...)
+		frame = binary.LittleEndian.AppendUint32(frame, crc32.Checksum(payload, crcTable))
+		err = ioutil.WriteFile(filepath.Join(moved, walLogFile), frame, 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openWALStore(moved)
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Fatalf("moved record read: %v", err)
+	}
+
+	// the log isn't read without the keys, nor without encryption once there are keys
+	useKeyfile("")
+	_, err = openWALStore(path)
+	if err == nil || !strings.Contains(err.Error(), errNoKeyfile.Error()) {
+		t.Fatalf("log read without a keyfile: %v", err)
+	}
+	plain := filepath.Join(dir, "plain")
+	store, err = openWALStore(plain)
+	if err == nil {
+		err = store.Put(&models.Person{Id: 32, Name: "Jaap Joosten"})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	useKeyfile(keys)
+	_, err = openWALStore(plain)
+	if err == nil || !strings.Contains(err.Error(), errPlainData.Error()) {
+		t.Fatalf("plain log read with a keyfile: %v", err)
+	}
+}
+
+func TestPlainDataRefused(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer useKeyfile("")
+
+	keys := filepath.Join(dir, "keys.json")
+	writeKeyfile(t, keys, map[string][]byte{"k1": newKey(t)}, "k1")
+	for _, backend := range []string{"file", "bolt"} {
+		path := filepath.Join(dir, backend+".data")
+		useKeyfile("")
+		store, err := openStore(backend, path)
+		if err == nil {
+			err = store.Put(&models.Person{Id: 32, Name: "Jaap Joosten"})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+
+		// data that isn't encrypted is only read to encrypt it
+		err = useKeyfile(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err = openStore(backend, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.Person(32)
+		if err == nil || !strings.Contains(err.Error(), errPlainData.Error()) {
+			t.Fatalf("%s: plain data read with a keyfile: %v", backend, err)
+		}
+		store.Close()
+
+		err = rotateKeysCommand([]string{"-store", backend, "-data", path, "-keyfile", keys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err = openStore(backend, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		person, err := store.Person(32)
+		if err != nil || person == nil || person.Name != "Jaap Joosten" {
+			t.Fatalf("%s: unexpected person %v, %v", backend, person, err)
+		}
+		store.Close()
+	}
+}
+
+func TestEncryptedValuesBound(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer useKeyfile("")
+
+	keys := filepath.Join(dir, "keys.json")
+	writeKeyfile(t, keys, map[string][]byte{"k1": newKey(t)}, "k1")
+	err := useKeyfile(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openBoltStore(filepath.Join(dir, "people.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	err = store.Put(&models.Person{Id: 32, Name: "Jaap Joosten"}, &models.Person{Id: 33, Name: "Anna Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a value moved to another person isn't decrypted
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(peopleBucket)
+		return bucket.Put(personKey(33), append([]byte(nil), bucket.Get(personKey(32))...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Person(33)
+	if err == nil {
+		t.Fatal("moved value read")
+	}
+	versions, err := store.History(32)
+	if err != nil || len(versions) != 1 || versions[0].Person.Name != "Jaap Joosten" {
+		t.Fatalf("unexpected history %v, %v", versions, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// readiness reports whether the server can serve queries.
+type readiness struct {
+	store PersonStore
+	// tenants are checked instead of the store when the server has tenants.
+	tenants  *tenants
+	draining int32
+}
+
+// readinessStatus is the response of the readiness endpoint.
+type readinessStatus struct {
+	Ready   bool     `json:"ready"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// drain marks the server as shutting down, so it's taken out of rotation while
+// the requests in flight finish.
+func (r *readiness) drain() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+// check returns the reasons the server isn't ready, if any.
+func (r *readiness) check() []string {
+	var reasons []string
+	if atomic.LoadInt32(&r.draining) == 1 {
+		reasons = append(reasons, "shutting down")
+	}
+	if _, err := cachedSchema(); err != nil {
+		reasons = append(reasons, fmt.Sprintf("schema not built: %v", err))
+	}
+	if r.tenants != nil {
+		for _, name := range r.tenants.names() {
+			if _, err := firstPerson(r.tenants.stores[name]); err != nil {
+				reasons = append(reasons, fmt.Sprintf("store of tenant %s not reachable: %v", name, err))
+			}
+		}
+	} else if _, err := firstPerson(r.store); err != nil {
+		reasons = append(reasons, fmt.Sprintf("store not reachable: %v", err))
+	}
+	return reasons
+}
+
+func (r *readiness) handler(w http.ResponseWriter, _ *http.Request) {
+	reasons := r.check()
+	status := readinessStatus{Ready: len(reasons) == 0, Reasons: reasons}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// healthHandler reports that the process is alive.
+func healthHandler(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/graphql-go/graphql"
+	"time"
+)
+
+// Version is a stored state of a person. Every change to a person in the store
+// creates a new version with a higher sequence number.
+type Version struct {
+	Seq  uint64
+	Time time.Time
+	// Person is nil when the version is a deletion.
+	Person *models.Person
+}
+
+// versionedPerson is a person as it was stored in a specific version. It resolves
+// as a Person through the generated PersonGetter interface.
+type versionedPerson struct {
+	*models.Person
+	seq uint64
+}
+
+func (p *versionedPerson) GetPerson() *models.Person {
+	return p.Person
+}
+
+var personVersionType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "PersonVersion",
+	Fields: graphql.FieldsThunk(func() graphql.Fields {
+		return graphql.Fields{
+			"seq": &graphql.Field{
+				Type: graphql.Int,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return int(p.Source.(Version).Seq), nil
+				},
+			},
+			"timestamp": &graphql.Field{
+				Type: graphql.DateTime,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Version).Time, nil
+				},
+			},
+			"deleted": &graphql.Field{
+				Type: graphql.Boolean,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Version).Person == nil, nil
+				},
+			},
+			"person": &graphql.Field{
+				Type: models.GraphQLPersonType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					version := p.Source.(Version)
+					if version.Person == nil {
+						return nil, nil
+					}
+					return &versionedPerson{Person: version.Person, seq: version.Seq}, nil
+				},
+			},
+		}
+	}),
+})
+
+func init() {
+	addField(models.GraphQLPersonType, "history", &graphql.Field{
+		Type:        graphql.NewList(personVersionType),
+		Description: "Earlier versions of the person, newest first.",
+		Args: graphql.FieldConfigArgument{
+			"first": &graphql.ArgumentConfig{Type: graphql.Int},
+		},
+		Resolve: resolveHistory,
+	})
+}
+
+// errHistoryDisabled is returned when the history of people is queried while the feature is off.
+var errHistoryDisabled = errors.New("the history of people is disabled")
+
+func resolveHistory(p graphql.ResolveParams) (interface{}, error) {
+	if !featuresFromContext(p.Context).History {
+		return nil, errHistoryDisabled
+	}
+	person, seq := sourcePerson(p.Source)
+	if person == nil {
+		return nil, fmt.Errorf("field history not resolved")
+	}
+
+	versions, err := storeFromContext(p.Context).History(person.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// the current person is the newest version, an older version only has the versions before it
+	earlier := []Version{}
+	for i, version := range versions {
+		if (seq == 0 && i > 0) || (seq != 0 && version.Seq < seq) {
+			earlier = append(earlier, version)
+		}
+	}
+
+	if first, ok := p.Args["first"].(int); ok && first >= 0 && first < len(earlier) {
+		earlier = earlier[:first]
+	}
+	return earlier, nil
+}
+
+// sourcePerson returns the person a field is resolved on and its version, which is
+// zero for the current state of the person.
+func sourcePerson(source interface{}) (*models.Person, uint64) {
+	switch source := source.(type) {
+	case *models.Person:
+		return source, 0
+	case *versionedPerson:
+		return source.Person, source.seq
+	}
+	return nil, 0
+}
+
+// personAsOf returns the person as it was stored at the given time, or nil when
+// it was not stored at that time.
+func personAsOf(store PersonStore, id int32, at time.Time) (interface{}, error) {
+	version, err := versionAsOf(store, id, at)
+	if err != nil || version == nil || version.Person == nil {
+		return nil, err
+	}
+	return &versionedPerson{Person: version.Person, seq: version.Seq}, nil
+}
+
+// versionAsOf returns the version of a person that was current at the given time,
+// or nil when the person wasn't stored before that time.
+func versionAsOf(store PersonStore, id int32, at time.Time) (*Version, error) {
+	versions, err := store.History(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range versions {
+		if !version.Time.After(at) {
+			return &version, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBoltHistory(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := openBoltStore(filepath.Join(dir, "people.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testHistory(t, store, nil)
+}
+
+func TestWALHistory(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { store.Close() }()
+
+	// the history has to survive compaction and a restart
+	testHistory(t, store, func() PersonStore {
+		err := store.Compact()
+		if err == nil {
+			err = store.Close()
+		}
+		if err == nil {
+			store, err = openWALStore(dir)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func testHistory(t *testing.T, store PersonStore, reopen func() PersonStore) {
+	changes := []func() error{
+		func() error { return store.Put(&models.Person{Id: 1, Name: "Jaap Joosten", Email: "jaap@joosten"}) },
+		func() error { return store.Delete(1) },
+		func() error { return store.Put(&models.Person{Id: 1, Name: "Jaap Joosten", Email: "jaap@example.com"}) },
+		func() error {
+			return store.Put(&models.Person{Id: 1, Name: "Jaap de Vries", Email: "jaap@example.com"})
+		},
+	}
+	for i, change := range changes {
+		err := change()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && reopen != nil {
+			store = reopen()
+		}
+	}
+
+	versions, err := store.History(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 || versions[0].Person.Name != "Jaap de Vries" || versions[2].Person != nil || versions[3].Person.Email != "jaap@joosten" {
+		t.Fatalf("unexpected history: %v", versions)
+	}
+
+	result, err := Query("(id: 1) { name history(first: 2) { deleted person { email } } }", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"person": map[string]interface{}{
+		"name": "Jaap de Vries",
+		"history": []interface{}{
+			map[string]interface{}{"deleted": false, "person": map[string]interface{}{"email": "jaap@example.com"}},
+			map[string]interface{}{"deleted": true, "person": nil},
+		},
+	}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Fatalf("response assertion failed: %v != %v", expected, result)
+	}
+
+	// as of the first version, the person only had the first version
+	asOf := versions[3].Time.Format(time.RFC3339Nano)
+	result, err = Query(fmt.Sprintf(`(id: 1, asOf: %q) { email history { seq } }`, asOf), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"person": map[string]interface{}{
+		"email":   "jaap@joosten",
+		"history": []interface{}{},
+	}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Fatalf("response assertion failed: %v != %v", expected, result)
+	}
+
+	result, err = Query(fmt.Sprintf(`(id: 1) { changes(since: %q) { path old new } }`, asOf), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"person": map[string]interface{}{
+		"changes": []interface{}{
+			map[string]interface{}{"path": "name", "old": "Jaap Joosten", "new": "Jaap de Vries"},
+			map[string]interface{}{"path": "email", "old": "jaap@joosten", "new": "jaap@example.com"},
+		},
+	}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Fatalf("response assertion failed: %v != %v", expected, result)
+	}
+
+	asOf = versions[3].Time.Add(-time.Second).Format(time.RFC3339Nano)
+	result, err = Query(fmt.Sprintf(`(id: 1, asOf: %q) { email }`, asOf), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(map[string]interface{}{"person": nil}, result) {
+		t.Fatalf("person served before it was stored: %v", result)
+	}
+}
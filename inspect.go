@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var wireTypeNames = map[int]string{
+	0: "varint",
+	1: "fixed64",
+	2: "bytes",
+	3: "start group",
+	4: "end group",
+	5: "fixed32",
+}
+
+// wireField is a field as it is encoded in the wire format.
+type wireField struct {
+	Offset   int64  `json:"offset"`
+	Path     string `json:"path"`
+	Number   int    `json:"field"`
+	WireType string `json:"wireType"`
+	Value    string `json:"value,omitempty"`
+}
+
+// wireError is the position where decoding the wire format broke.
+type wireError struct {
+	Offset int64  `json:"offset"`
+	Number int    `json:"field,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (e *wireError) Error() string {
+	if e.Number == 0 {
+		return fmt.Sprintf("at offset %d: %s", e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("at offset %d, field %d: %s", e.Offset, e.Number, e.Reason)
+}
+
+// schemaField is a field of a message as declared in the generated struct tags.
+type schemaField struct {
+	name     string
+	wireType int
+	message  reflect.Type
+}
+
+// inspection is the report of a single message in a data file.
+type inspection struct {
+	Record  int             `json:"record"`
+	Offset  int64           `json:"offset"`
+	Size    int             `json:"size"`
+	Person  json.RawMessage `json:"person,omitempty"`
+	Unknown []wireField     `json:"unknownFields,omitempty"`
+	Fields  []wireField     `json:"fields,omitempty"`
+	Error   *wireError      `json:"error,omitempty"`
+
+	person *models.Person
+}
+
+// inspectCommand decodes a data file and reports its contents, the fields that
+// aren't part of models.proto and the position where decoding breaks.
+func inspectCommand(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	format := flags.String("format", "text", "output format: text or json")
+	keys := addDataFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: inspect [-format text|json] [-keyfile keys.json] [-signing-keys public.pem] data.bin")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	err := keys.use()
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err == nil {
+		data, err = verifyData(data)
+	}
+	if err == nil && bytes.HasPrefix(data, []byte(encryptionMagic)) {
+		data, err = decryptRecords(data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read data: %v", err)
+	}
+
+	inspections, streamErr := inspectStream(data)
+	if streamErr != nil && len(inspections) == 0 {
+		// a file that isn't a stream of records may hold a single bare person
+		single := inspectMessage(0, 0, data)
+		if single.Error != nil {
+			fmt.Fprintf(os.Stderr, "not a stream of length-delimited records: %v\n", streamErr)
+		}
+		inspections = []inspection{single}
+	}
+
+	failed := false
+	for _, inspection := range inspections {
+		err = printInspection(os.Stdout, *format, inspection)
+		if err != nil {
+			return err
+		}
+		failed = failed || inspection.Error != nil
+	}
+
+	if failed {
+		return fmt.Errorf("failed to decode %s", flags.Arg(0))
+	}
+	return nil
+}
+
+// decryptRecords returns the records of an encrypted data file as a stream that
+// isn't encrypted, so they can be inspected. The offsets in the report are those of
+// the decrypted stream.
+func decryptRecords(data []byte) ([]byte, error) {
+	reader := newPersonReader(bytes.NewReader(data))
+	var plain []byte
+	for {
+		record, err := reader.NextRecord()
+		if err == io.EOF {
+			return plain, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		plain = binary.AppendUvarint(plain, uint64(len(record)))
+		plain = append(plain, record...)
+	}
+}
+
+// inspectStream inspects the records of a data file up to and including the first
+// record that doesn't decode. The error is set when the file isn't a valid stream.
+func inspectStream(data []byte) ([]inspection, error) {
+	var inspections []inspection
+	var offset int64
+	for record := 0; offset < int64(len(data)); record++ {
+		size, n := binary.Uvarint(data[offset:])
+		if n <= 0 || size > uint64(int64(len(data))-offset-int64(n)) {
+			return inspections, &wireError{Offset: offset, Reason: fmt.Sprintf("invalid length of record %d", record)}
+		}
+
+		start := offset + int64(n)
+		inspection := inspectMessage(record, start, data[start:start+int64(size)])
+		if inspection.Error != nil && len(inspections) == 0 {
+			return nil, inspection.Error
+		}
+
+		inspection.Offset = offset
+		inspections = append(inspections, inspection)
+		if inspection.Error != nil {
+			return inspections, inspection.Error
+		}
+		offset = start + int64(size)
+	}
+	return inspections, nil
+}
+
+// inspectMessage decodes a single Person message that starts at the given offset in the file.
+func inspectMessage(record int, offset int64, data []byte) inspection {
+	inspection := inspection{Record: record, Offset: offset, Size: len(data)}
+
+	var fields []wireField
+	wireErr := walkWire(data, offset, reflect.TypeOf(models.Person{}), "", func(field wireField, known bool) {
+		fields = append(fields, field)
+		if !known {
+			inspection.Unknown = append(inspection.Unknown, field)
+		}
+	})
+
+	person := &models.Person{}
+	err := proto.Unmarshal(data, person)
+	if err == nil && wireErr == nil {
+		inspection.person = person
+		return inspection
+	}
+
+	// show the raw fields up to the point where decoding broke
+	inspection.Fields = fields
+	inspection.Error = wireErr
+	if inspection.Error == nil {
+		inspection.Error = &wireError{Offset: offset, Reason: err.Error()}
+	}
+	return inspection
+}
+
+// walkWire decodes the wire format of a message of the given type and calls visit
+// for every field, reporting whether the field is declared in models.proto.
+func walkWire(data []byte, base int64, message reflect.Type, prefix string, visit func(field wireField, known bool)) *wireError {
+	schema := messageSchema(message)
+
+	for i := 0; i < len(data); {
+		offset := base + int64(i)
+		tag, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return &wireError{Offset: offset, Reason: "invalid tag"}
+		}
+		i += n
+
+		number, wireType := int(tag>>3), int(tag&7)
+		if number <= 0 || number > math.MaxInt32 {
+			return &wireError{Offset: offset, Number: number, Reason: "invalid field number"}
+		}
+
+		field := wireField{Offset: offset, Number: number, WireType: wireTypeNames[wireType]}
+		declared, known := schema[number]
+		field.Path = prefix + strconv.Itoa(number)
+		if known {
+			field.Path = prefix + declared.name
+			if declared.wireType != wireType {
+				return &wireError{Offset: offset, Number: number, Reason: fmt.Sprintf("field %s has wire type %d, expected %d", declared.name, wireType, declared.wireType)}
+			}
+		}
+
+		switch wireType {
+		case 0:
+			value, n := binary.Uvarint(data[i:])
+			if n <= 0 {
+				return &wireError{Offset: base + int64(i), Number: number, Reason: "invalid varint"}
+			}
+			field.Value = strconv.FormatUint(value, 10)
+			i += n
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(data)-i < size {
+				return &wireError{Offset: base + int64(i), Number: number, Reason: "truncated fixed value"}
+			}
+			field.Value = fmt.Sprintf("0x%x", data[i:i+size])
+			i += size
+		case 2:
+			size, n := binary.Uvarint(data[i:])
+			if n <= 0 || size > uint64(len(data)-i-n) {
+				return &wireError{Offset: base + int64(i), Number: number, Reason: "invalid length"}
+			}
+			i += n
+			value := data[i : i+int(size)]
+			if known && declared.message != nil {
+				visit(field, known)
+				err := walkWire(value, base+int64(i), declared.message, field.Path+".", visit)
+				if err != nil {
+					return err
+				}
+				i += int(size)
+				continue
+			}
+			field.Value = strconv.Quote(string(value))
+			i += int(size)
+		default:
+			return &wireError{Offset: offset, Number: number, Reason: fmt.Sprintf("unsupported wire type %d", wireType)}
+		}
+
+		visit(field, known)
+	}
+	return nil
+}
+
+// messageSchema returns the fields of a generated message by field number.
+func messageSchema(message reflect.Type) map[int]schemaField {
+	schema := make(map[int]schemaField)
+	for i := 0; i < message.NumField(); i++ {
+		field := message.Field(i)
+		options := strings.Split(field.Tag.Get("protobuf"), ",")
+		if len(options) < 2 {
+			continue
+		}
+
+		number, err := strconv.Atoi(options[1])
+		if err != nil {
+			continue
+		}
+
+		declared := schemaField{wireType: 2}
+		switch options[0] {
+		case "varint", "zigzag32", "zigzag64":
+			declared.wireType = 0
+		case "fixed64":
+			declared.wireType = 1
+		case "fixed32":
+			declared.wireType = 5
+		}
+		for _, option := range options {
+			if strings.HasPrefix(option, "name=") {
+				declared.name = strings.TrimPrefix(option, "name=")
+			}
+		}
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			declared.message = field.Type.Elem()
+		}
+		schema[number] = declared
+	}
+	return schema
+}
+
+func printInspection(w io.Writer, format string, inspection inspection) error {
+	if format == "json" {
+		if inspection.person != nil {
+			person, err := (&jsonpb.Marshaler{}).MarshalToString(inspection.person)
+			if err != nil {
+				return err
+			}
+			inspection.Person = json.RawMessage(person)
+		}
+		return json.NewEncoder(w).Encode(inspection)
+	}
+
+	fmt.Fprintf(w, "record %d at offset %d (%d bytes)\n", inspection.Record, inspection.Offset, inspection.Size)
+	if inspection.person != nil {
+		fmt.Fprint(w, proto.MarshalTextString(inspection.person))
+	}
+	for _, field := range inspection.Fields {
+		fmt.Fprintf(w, "  %d: %s (field %d, %s) %s\n", field.Offset, field.Path, field.Number, field.WireType, field.Value)
+	}
+	if inspection.person != nil && len(inspection.Unknown) > 0 {
+		fmt.Fprintln(w, "unknown fields, kept in XXX_unrecognized:")
+		for _, field := range inspection.Unknown {
+			fmt.Fprintf(w, "  %d: %s (field %d, %s) %s\n", field.Offset, field.Path, field.Number, field.WireType, field.Value)
+		}
+	}
+	if inspection.Error != nil {
+		fmt.Fprintf(w, "decoding failed %v\n", inspection.Error)
+	}
+	fmt.Fprintln(w)
+	return nil
+}
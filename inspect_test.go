@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInspectStream(t *testing.T) {
+	inspections, err := inspectStream([]byte{
+		// record 0: name "Jaap", id 32 and the unknown field 7
+		0x0a, 0x0a, 0x04, 'J', 'a', 'a', 'p', 0x10, 0x20, 0x38, 0x03,
+		// record 1: a phone with the number encoded as varint
+		0x04, 0x22, 0x02, 0x08, 0x01,
+	})
+	if err == nil || len(inspections) != 2 {
+		t.Fatalf("expected two records and an error, got %d records and %v", len(inspections), err)
+	}
+
+	first := inspections[0]
+	if first.person == nil || first.person.Name != "Jaap" || first.person.Id != 32 {
+		t.Fatalf("unexpected first record: %v", first.person)
+	}
+	expected := []wireField{{Offset: 9, Path: "7", Number: 7, WireType: "varint", Value: "3"}}
+	if !reflect.DeepEqual(expected, first.Unknown) {
+		t.Fatalf("unexpected unknown fields: %v", first.Unknown)
+	}
+
+	second := inspections[1]
+	if second.person != nil || second.Offset != 11 {
+		t.Fatalf("unexpected second record: %v", second)
+	}
+	expectedErr := &wireError{Offset: 14, Number: 1, Reason: "field number has wire type 0, expected 2"}
+	if !reflect.DeepEqual(expectedErr, second.Error) {
+		t.Fatalf("unexpected error: %v", second.Error)
+	}
+}
+
+func TestInspectLegacyData(t *testing.T) {
+	inspections, err := inspectStream([]byte{0x0a, 0x02, 'J', 'a'})
+	if err == nil || len(inspections) != 0 {
+		t.Fatalf("bare person read as stream: %v", inspections)
+	}
+
+	inspection := inspectMessage(0, 0, []byte{0x0a, 0x02, 'J', 'a'})
+	if inspection.Error != nil || inspection.person.Name != "Ja" {
+		t.Fatalf("unexpected inspection: %v", inspection)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"math"
+	"strconv"
+)
+
+// defaultListSize is the number of elements assumed for a list that can't be limited
+// with a first argument.
+const defaultListSize = 10
+
+// maxListSize caps the number of elements a list is counted with, whatever its first
+// argument asks for. A list that returns all its elements without first is counted
+// with it.
+const maxListSize = 1000
+
+// maxCost is the ceiling the cost of a query saturates at, so it can't overflow.
+const maxCost = math.MaxInt32
+
+// fieldCosts are the costs of the fields that read from the store. Other fields cost 1.
+var fieldCosts = map[string]int{
+	"Query.person":   2,
+	"Person.history": 5,
+	"Person.changes": 5,
+}
+
+// complexity is the size of an operation, computed before it is executed.
+type complexity struct {
+	Depth      int `json:"depth"`
+	Aliases    int `json:"aliases"`
+	RootFields int `json:"rootFields"`
+	Cost       int `json:"cost"`
+}
+
+type limitsKey struct{}
+
+// withLimits limits the complexity of the queries executed with the context.
+func withLimits(ctx context.Context, limits Limits) context.Context {
+	return context.WithValue(ctx, limitsKey{}, limits)
+}
+
+func limitsFromContext(ctx context.Context) (Limits, bool) {
+	limits, ok := ctx.Value(limitsKey{}).(Limits)
+	return limits, ok
+}
+
+// check returns the error for the first limit the complexity exceeds.
+func (l Limits) check(c complexity) *queryError {
+	for _, limit := range []struct {
+		code  string
+		name  string
+		value int
+		max   int64
+	}{
+		{"MAX_DEPTH_EXCEEDED", "depth", c.Depth, l.MaxDepth},
+		{"MAX_ALIASES_EXCEEDED", "number of aliases", c.Aliases, l.MaxAliases},
+		{"MAX_ROOT_FIELDS_EXCEEDED", "number of root fields", c.RootFields, l.MaxRootFields},
+		{"MAX_COST_EXCEEDED", "cost", c.Cost, l.MaxCost},
+	} {
+		// a negative value can only be an overflow, which is over any limit
+		if limit.max <= 0 || limit.value >= 0 && int64(limit.value) <= limit.max {
+			continue
+		}
+
+		message := fmt.Sprintf("query %s %d exceeds the maximum of %d", limit.name, limit.value, limit.max)
+		err := gqlerrors.NewFormattedError(message)
+		err.Extensions = map[string]interface{}{
+			"code":       limit.code,
+			"limit":      limit.max,
+			"depth":      c.Depth,
+			"aliases":    c.Aliases,
+			"rootFields": c.RootFields,
+			"cost":       c.Cost,
+		}
+		return newQueryError(limit.code, fmt.Errorf("failed to execute graphql operation: %s", message), []gqlerrors.FormattedError{err})
+	}
+	return nil
+}
+
+// analyzer computes the complexity of an operation from a validated document.
+type analyzer struct {
+	schema     graphql.Schema
+	fragments  map[string]*ast.FragmentDefinition
+	variables  map[string]interface{}
+	defaults   map[string]ast.Value
+	complexity complexity
+}
+
+// analyze computes the complexity of the operation in a document that is executed
+// for the given operation name. The cost of a field is multiplied by the number of
+// elements of the lists it's in, as asked for with first.
+func analyze(schema graphql.Schema, document *ast.Document, operationName string, variables map[string]interface{}) complexity {
+	a := &analyzer{schema: schema, fragments: make(map[string]*ast.FragmentDefinition), variables: variables, defaults: make(map[string]ast.Value)}
+
+	var operation *ast.OperationDefinition
+	for _, definition := range document.Definitions {
+		switch definition := definition.(type) {
+		case *ast.OperationDefinition:
+			if operation == nil && (operationName == "" || definition.Name != nil && definition.Name.Value == operationName) {
+				operation = definition
+			}
+		case *ast.FragmentDefinition:
+			a.fragments[definition.Name.Value] = definition
+		}
+	}
+	if operation == nil {
+		return a.complexity
+	}
+	for _, definition := range operation.VariableDefinitions {
+		if definition.DefaultValue != nil {
+			a.defaults[definition.Variable.Name.Value] = definition.DefaultValue
+		}
+	}
+
+	root := schema.QueryType()
+	if operation.Operation == ast.OperationTypeMutation {
+		root = schema.MutationType()
+	}
+	if root == nil {
+		return a.complexity
+	}
+	a.complexity.Cost = a.selectionCost(root, operation.SelectionSet, 1)
+	return a.complexity
+}
+
+func (a *analyzer) selectionCost(parent graphql.Type, selections *ast.SelectionSet, depth int) int {
+	if parent == nil || selections == nil {
+		return 0
+	}
+
+	cost := 0
+	for _, selection := range selections.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if depth == 1 {
+				a.complexity.RootFields++
+			}
+			if depth > a.complexity.Depth {
+				a.complexity.Depth = depth
+			}
+			if selection.Alias != nil {
+				a.complexity.Aliases++
+			}
+			cost = addCost(cost, a.fieldCost(parent, selection, depth))
+		case *ast.InlineFragment:
+			fragmentType := parent
+			if selection.TypeCondition != nil {
+				fragmentType = a.schema.Type(selection.TypeCondition.Name.Value)
+			}
+			cost = addCost(cost, a.selectionCost(fragmentType, selection.SelectionSet, depth))
+		case *ast.FragmentSpread:
+			if fragment, ok := a.fragments[selection.Name.Value]; ok {
+				cost = addCost(cost, a.selectionCost(a.schema.Type(fragment.TypeCondition.Name.Value), fragment.SelectionSet, depth))
+			}
+		}
+	}
+	return cost
+}
+
+func (a *analyzer) fieldCost(parent graphql.Type, field *ast.Field, depth int) int {
+	name := field.Name.Value
+	cost, ok := fieldCosts[parent.Name()+"."+name]
+	if !ok {
+		cost = 1
+	}
+
+	definition := fieldDefinition(parent, name)
+	if definition == nil || field.SelectionSet == nil {
+		return cost
+	}
+
+	fieldType, list := definition.Type, false
+	for {
+		switch t := fieldType.(type) {
+		case *graphql.NonNull:
+			fieldType = t.OfType
+			continue
+		case *graphql.List:
+			fieldType, list = t.OfType, true
+			continue
+		}
+		break
+	}
+
+	children := a.selectionCost(fieldType, field.SelectionSet, depth+1)
+	if list {
+		children = multiplyCost(children, a.listSize(definition, field))
+	}
+	return addCost(cost, children)
+}
+
+// addCost adds costs, saturating at maxCost.
+func addCost(a, b int) int {
+	if a > maxCost-b {
+		return maxCost
+	}
+	return a + b
+}
+
+// multiplyCost multiplies a cost by a list size, saturating at maxCost.
+func multiplyCost(cost, size int) int {
+	if size != 0 && cost > maxCost/size {
+		return maxCost
+	}
+	return cost * size
+}
+
+// listSize returns the number of elements a list field is asked for, at most maxListSize.
+// A list with a first argument returns all its elements when first is left out,
+// null or negative, so it's counted at maxListSize.
+func (a *analyzer) listSize(definition *graphql.FieldDefinition, field *ast.Field) int {
+	unbounded := defaultListSize
+	for _, argument := range definition.Args {
+		if argument.Name() == "first" {
+			unbounded = maxListSize
+		}
+	}
+
+	for _, argument := range field.Arguments {
+		if argument.Name.Value != "first" {
+			continue
+		}
+
+		var size float64
+		switch value := a.argumentValue(argument.Value).(type) {
+		case float64:
+			size = value
+		case int:
+			size = float64(value)
+		default:
+			return unbounded
+		}
+		if size < 0 || math.IsNaN(size) {
+			return unbounded
+		}
+		if size > maxListSize {
+			return maxListSize
+		}
+		return int(size)
+	}
+	return unbounded
+}
+
+// argumentValue returns the value of an integer argument, from the variables or the
+// defaults of the variables of the operation, or nil when it isn't set.
+func (a *analyzer) argumentValue(value ast.Value) interface{} {
+	if variable, ok := value.(*ast.Variable); ok {
+		name := variable.Name.Value
+		if value, ok := a.variables[name]; ok {
+			return value
+		}
+		value = a.defaults[name]
+	}
+	if value, ok := value.(*ast.IntValue); ok {
+		size, err := strconv.ParseFloat(value.Value, 64)
+		if err != nil {
+			return math.Inf(1)
+		}
+		return size
+	}
+	return nil
+}
+
+func fieldDefinition(parent graphql.Type, name string) *graphql.FieldDefinition {
+	switch name {
+	case "__schema":
+		return graphql.SchemaMetaFieldDef
+	case "__type":
+		return graphql.TypeMetaFieldDef
+	case "__typename":
+		return graphql.TypeNameMetaFieldDef
+	}
+	if object, ok := parent.(*graphql.Object); ok {
+		return object.Fields()[name]
+	}
+	return nil
+}
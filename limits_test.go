@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	schema, err := cachedSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query     string
+		variables map[string]interface{}
+		expected  complexity
+	}{
+		{`{ person { name email } }`, nil, complexity{Depth: 2, RootFields: 1, Cost: 4}},
+		{`{ a: person { name } b: person(id: 2) { name } }`, nil, complexity{Depth: 2, Aliases: 2, RootFields: 2, Cost: 6}},
+		{`{ person { history(first: 3) { seq person { name } } } }`, nil, complexity{Depth: 4, RootFields: 1, Cost: 2 + 5 + 3*(1+1+1)}},
+		{`query($n: Int) { person { history(first: $n) { seq } } }`, map[string]interface{}{"n": float64(50)}, complexity{Depth: 3, RootFields: 1, Cost: 2 + 5 + 50}},
+		{`{ person { ...versions } } fragment versions on Person { history { seq } }`, nil, complexity{Depth: 3, RootFields: 1, Cost: 2 + 5 + maxListSize}},
+		{`{ person { history(first: -1) { seq } } }`, nil, complexity{Depth: 3, RootFields: 1, Cost: 2 + 5 + maxListSize}},
+		{`query($n: Int = 100000) { person { history(first: $n) { seq } } }`, nil, complexity{Depth: 3, RootFields: 1, Cost: 2 + 5 + maxListSize}},
+		{`query($n: Int = 20) { person { history(first: $n) { seq } } }`, nil, complexity{Depth: 3, RootFields: 1, Cost: 2 + 5 + 20}},
+		{`query($n: Int = 20) { person { history(first: $n) { seq } } }`, map[string]interface{}{"n": nil}, complexity{Depth: 3, RootFields: 1, Cost: 2 + 5 + maxListSize}},
+		{`query($n: Int) { person { history(first: $n) { seq } } }`, nil, complexity{Depth: 3, RootFields: 1, Cost: 2 + 5 + maxListSize}},
+		{`{ person { changes(since: "2019-10-01T12:00:00Z") { path } } }`, nil, complexity{Depth: 3, RootFields: 1, Cost: 2 + 5 + defaultListSize}},
+	} {
+		document, err := documents.parse(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := analyze(schema, document, "", test.variables)
+		if actual != test.expected {
+			t.Fatalf("query %s has complexity %+v, expected %+v", test.query, actual, test.expected)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ctx := withLimits(context.Background(), Limits{MaxDepth: 3, MaxCost: 20})
+	store := newFileStore("data.bin")
+
+	_, err := execute(ctx, queryRequest{Query: `{ person { history(first: 1) { seq } } }`}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = execute(ctx, queryRequest{Query: `{ person { history(first: 100) { seq } } }`}, store)
+	failed, ok := err.(*queryError)
+	if !ok || failed.errors[0].Extensions["code"] != "MAX_COST_EXCEEDED" || failed.errors[0].Extensions["cost"] != 107 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	_, err = execute(ctx, queryRequest{Query: `{ person { history { person { name } } } }`}, store)
+	failed, ok = err.(*queryError)
+	if !ok || failed.errors[0].Extensions["code"] != "MAX_DEPTH_EXCEEDED" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestCostOverflow(t *testing.T) {
+	ctx := withLimits(context.Background(), defaultConfig().Limits)
+	history := "history(first: 2147483647) { person { %s } }"
+	query := "seq"
+	for i := 0; i < 4; i++ {
+		query = fmt.Sprintf(history, query)
+	}
+	query = "{ person { " + strings.Replace(query, " person { seq }", " seq", 1) + " } }"
+
+	_, err := execute(ctx, queryRequest{Query: query}, newFileStore("data.bin"))
+	failed, ok := err.(*queryError)
+	if !ok || failed.errors[0].Extensions["code"] != "MAX_COST_EXCEEDED" || failed.errors[0].Extensions["cost"] != maxCost {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err := (Limits{MaxCost: 1000}).check(complexity{Cost: -1}); err == nil {
+		t.Fatal("negative cost accepted")
+	}
+}
@@ -1,76 +1,520 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
-	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/mux"
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
+// commands are run instead of the server when their name is the first argument.
+var commands = map[string]func(args []string) error{
+	"migrate":      migrateCommand,
+	"diff":         diffCommand,
+	"import":       importCommand,
+	"export":       exportCommand,
+	"inspect":      inspectCommand,
+	"query":        queryCommand,
+	"rotate-keys":  rotateKeysCommand,
+	"sign":         signCommand,
+	"verify-audit": verifyAuditCommand,
+}
+
 func main() {
-	router := mux.NewRouter()
-	router.HandleFunc("/query", queryHandler).Methods(http.MethodPost)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			err := command(os.Args[2:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", router))
-}
+	config, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
 
-func queryHandler(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	shutdownTracing, err := setupTracing(context.Background(), config.Tracing)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
-		return
+		log.Fatal(err)
 	}
+	defer shutdownTracing(context.Background())
 
-	data, err := getData()
+	err = useKeyfile(config.Encryption.Keyfile)
+	if err == nil {
+		err = useSigning(config.Signing)
+	}
+	if err == nil {
+		err = usePhoneRegion(config.Phone.DefaultRegion)
+	}
+	if err == nil {
+		err = useRetention(config.Retention)
+	}
+	if err == nil {
+		err = useHashKey(config.Masking.HashKey)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading data: %v", err), http.StatusBadRequest)
-		return
+		log.Fatal(err)
 	}
 
-	result, err := Query(string(body), data)
+	tenants, err := openTenants(config)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error executing query: %v", err), http.StatusBadRequest)
-		return
+		log.Fatal(err)
+	}
+	var store PersonStore
+	if tenants != nil {
+		defer tenants.Close()
+	} else {
+		store, err = openStore(config.Store, config.Data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer store.Close()
+	}
+
+	ready := &readiness{store: store, tenants: tenants}
+	router := mux.NewRouter()
+	persisted, err := newPersistedQueries(config.PersistedQueries)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	err = json.NewEncoder(w).Encode(result)
+	auth, err := authenticate(config.Auth)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading writing response: %v", err), http.StatusBadRequest)
+		log.Fatal(err)
+	}
+
+	limiter := newRateLimiter(config.RateLimits)
+	audit, err := openAuditLog(config.Audit.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer audit.Close()
+
+	query := limiter.guard(auth(limiter.middleware(tenants.middleware(audit.middleware(queryHandler(store, config, persisted))))))
+	if config.Logging.Access {
+		query = accessLog(slog.New(slog.NewJSONHandler(os.Stderr, nil)), config.Logging, query)
+	}
+	router.Handle("/query", query).Methods(http.MethodPost)
+	router.HandleFunc("/healthz", healthHandler).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", ready.handler).Methods(http.MethodGet)
+	router.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+
+	server := &http.Server{
+		Addr:         config.Listen,
+		Handler:      router,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		err := shutdown(server, ready, config)
+		if err != nil {
+			log.Printf("failed to drain requests: %v", err)
+		}
+		close(drained)
+	}()
+
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
+}
+
+// shutdown takes the server out of rotation: /readyz fails for the shutdown delay
+// while requests are still served, after which the server stops accepting
+// connections and drains the requests in flight.
+func shutdown(server *http.Server, ready *readiness, config Config) error {
+	ready.drain()
+	log.Printf("shutting down in %v, draining requests for up to %v", config.ShutdownDelay, config.ShutdownTimeout)
+	time.Sleep(config.ShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+func queryHandler(store PersonStore, config Config, persisted *persistedQueries) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "POST /query", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, config.MaxBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// a body holding a GraphQL request is executed as is, otherwise it filters the person
+		var request queryRequest
+		if json.Unmarshal(body, &request) != nil || (request.Query == "" && request.Extensions.PersistedQuery == nil) {
+			request = queryRequest{Query: personQuery(string(body))}
+		}
+
+		ctx = withMasking(withLimits(withFeatures(ctx, config.Features), config.Limits), config.Masking)
+		ctx = withPolicy(ctx, config.Policies.policy)
+		if config.Tracing.Resolvers {
+			ctx = withResolverSpans(ctx)
+		}
+
+		var result interface{}
+		switch {
+		case persisted != nil:
+			if failed := persisted.resolve(&request); failed != nil {
+				err = failed
+			}
+		case request.Query == "":
+			err = persistedQueryError("PERSISTED_QUERY_NOT_SUPPORTED", "PersistedQueryNotSupported")
+		}
+		if err == nil {
+			requestStore := store
+			if tenant := tenantFromContext(ctx); tenant != nil {
+				requestStore = tenant.store
+			}
+			result, err = execute(ctx, request, requestStore)
+		}
+		if err != nil {
+			recordError(span, err)
+			var failed *queryError
+			if !errors.As(err, &failed) {
+				http.Error(w, fmt.Sprintf("Error executing query: %v", err), http.StatusBadRequest)
+				return
+			}
+			if info := queryInfoFromContext(ctx); info != nil {
+				info.codes = failed.codes()
+			}
+			if failed.data != nil {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{"data": failed.data, "errors": failed.errors})
+				return
+			}
+			writeQueryError(w, failed)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading writing response: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// writeErrors writes a GraphQL response that only holds errors.
+func writeErrors(w http.ResponseWriter, status int, errs []gqlerrors.FormattedError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errs})
+}
+
+// writeQueryError writes the errors of a request that wasn't executed, which can
+// be retried after a while when it was rate limited.
+func writeQueryError(w http.ResponseWriter, failed *queryError) {
+	if failed.retryAfter <= 0 {
+		writeErrors(w, http.StatusBadRequest, failed.errors)
 		return
 	}
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(failed.retryAfter)))
+	writeErrors(w, http.StatusTooManyRequests, failed.errors)
+}
+
+// queryRequest is a GraphQL request in the JSON format used by GraphQL clients.
+type queryRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	Extensions    struct {
+		PersistedQuery *persistedQuery `json:"persistedQuery,omitempty"`
+	} `json:"extensions"`
+}
+
+func Query(filtering string, store PersonStore) (interface{}, error) {
+	return execute(context.Background(), queryRequest{Query: personQuery(filtering)}, store)
 }
 
-func Query(filtering string, person *models.Person) (interface{}, error) {
-	schema, err := queryScheme(person)
+// personQuery injects filtering in a query on the person.
+func personQuery(filtering string) string {
+	return fmt.Sprintf(`{ person %s }`, filtering)
+}
+
+func execute(ctx context.Context, request queryRequest, store PersonStore) (interface{}, error) {
+	start := time.Now()
+	operation, outcome := request.OperationName, outcomeSuccess
+	// the operation only labels metrics once the document is known to hold it
+	label := operationInvalid
+	defer func() {
+		observeQuery(label, outcome, start)
+		if info := queryInfoFromContext(ctx); info != nil {
+			info.operation = operation
+			info.queryHash = queryHash(request.Query)
+			info.variables = request.Variables
+		}
+		if trail := auditTrailFromContext(ctx); trail != nil {
+			trail.operation = operation
+		}
+	}()
+
+	schema, err := cachedSchema()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create schema: %v", err)
+		outcome = outcomeSchemaError
+		return nil, newQueryError(codeInternal, fmt.Errorf("failed to create schema: %v", err), nil)
 	}
 
-	// inject filtering in query
-	query := fmt.Sprintf(`{ person %s }`, filtering)
-	params := graphql.Params{Schema: schema, RequestString: query}
-	result := graphql.Do(params)
+	_, span := tracer.Start(ctx, "graphql.parse")
+	document, err := documents.parse(request.Query)
+	endSpan(span, err)
+	if err != nil {
+		outcome = outcomeParseError
+		return nil, newQueryError(codeParseFailed, fmt.Errorf("failed to execute graphql operation: %v", err), gqlerrors.FormatErrors(err))
+	}
+	if operation == "" {
+		operation = operationName(document)
+	}
+	if !featuresFromContext(ctx).Introspection && usesIntrospection(document) {
+		outcome = outcomeRejected
+		return nil, newQueryError(codeIntrospectionDisabled, fmt.Errorf("failed to execute graphql operation: introspection is disabled"), gqlerrors.FormatErrors(errors.New("introspection is disabled")))
+	}
+
+	_, span = tracer.Start(ctx, "graphql.validate")
+	validation := graphql.ValidateDocument(&schema, document, nil)
+	span.End()
+	if !validation.IsValid {
+		outcome = outcomeValidationError
+		return nil, newQueryError(codeValidationFailed, fmt.Errorf("failed to execute graphql operation: %v", validation.Errors), validation.Errors)
+	}
+	if hasOperation(document, operation) {
+		label = operationLabel(operation)
+	}
+
+	if limits, ok := limitsFromContext(ctx); ok {
+		complexity := analyze(schema, document, request.OperationName, request.Variables)
+		if info := queryInfoFromContext(ctx); info != nil {
+			info.cost = complexity.Cost
+		}
+		if failed := limits.check(complexity); failed != nil {
+			outcome = outcomeRejected
+			return nil, failed
+		}
+		if charge := costQuotaFromContext(ctx); charge != nil {
+			if failed := charge(complexity.Cost); failed != nil {
+				outcome = outcomeRejected
+				return nil, failed
+			}
+		}
+	}
+
+	ctx, span = tracer.Start(ctx, "graphql.execute", trace.WithAttributes(attribute.String("graphql.operation.name", operation)))
+	defer span.End()
+	params := graphql.ExecuteParams{
+		Schema:        schema,
+		AST:           document,
+		Args:          request.Variables,
+		OperationName: request.OperationName,
+		Context:       withStore(ctx, store),
+	}
+	result := graphql.Execute(params)
 
 	if len(result.Errors) > 0 {
-		return nil, fmt.Errorf("failed to execute graphql operation: %v", result.Errors)
+		outcome = outcomeExecutionError
+		span.SetStatus(codes.Error, result.Errors[0].Message)
+		failed := newQueryError(codeInternal, fmt.Errorf("failed to execute graphql operation: %v", result.Errors), result.Errors)
+		failed.data = result.Data
+		return nil, failed
 	}
 
 	return result.Data, nil
 }
 
-func queryScheme(person interface{}) (graphql.Schema, error) {
+// error codes of failed requests, as used by GraphQL clients
+const (
+	codeParseFailed           = "GRAPHQL_PARSE_FAILED"
+	codeValidationFailed      = "GRAPHQL_VALIDATION_FAILED"
+	codeIntrospectionDisabled = "INTROSPECTION_DISABLED"
+	codeInternal              = "INTERNAL_SERVER_ERROR"
+)
+
+// queryError is a failed GraphQL request and the errors reported to the client.
+type queryError struct {
+	err    error
+	errors []gqlerrors.FormattedError
+	// data is the partial result of a query of which some fields failed, which
+	// are null.
+	data interface{}
+	// retryAfter is when a rate limited request can be retried.
+	retryAfter time.Duration
+}
+
+// newQueryError returns a failed request that reports the given errors, or err
+// when there are none. Errors without a code get the given code.
+func newQueryError(code string, err error, errs []gqlerrors.FormattedError) *queryError {
+	if len(errs) == 0 {
+		errs = gqlerrors.FormatErrors(err)
+	}
+	for i := range errs {
+		if _, ok := errs[i].Extensions["code"]; ok {
+			continue
+		}
+		extensions := map[string]interface{}{"code": code}
+		for name, value := range errs[i].Extensions {
+			extensions[name] = value
+		}
+		errs[i].Extensions = extensions
+	}
+	return &queryError{err: err, errors: errs}
+}
+
+// codes returns the codes of the reported errors.
+func (e *queryError) codes() []string {
+	codes := make([]string, 0, len(e.errors))
+	for _, err := range e.errors {
+		codes = append(codes, fmt.Sprint(err.Extensions["code"]))
+	}
+	return codes
+}
+
+func (e *queryError) Error() string {
+	return e.err.Error()
+}
+
+// operationName returns the name of the only operation in a document, if it has one.
+func operationName(document *ast.Document) string {
+	name := ""
+	for _, definition := range document.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok {
+			if name != "" || operation.Name == nil {
+				return ""
+			}
+			name = operation.Name.Value
+		}
+	}
+	return name
+}
+
+// hasOperation reports whether a document holds the operation with the given name,
+// or an anonymous operation for an empty name.
+func hasOperation(document *ast.Document, name string) bool {
+	for _, definition := range document.Definitions {
+		if operation, ok := definition.(*ast.OperationDefinition); ok {
+			if name == "" && operation.Name == nil || operation.Name != nil && operation.Name.Value == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// usesIntrospection reports whether a document queries the __schema or __type fields.
+func usesIntrospection(document *ast.Document) bool {
+	var selections []ast.Selection
+	for _, definition := range document.Definitions {
+		switch definition := definition.(type) {
+		case *ast.OperationDefinition:
+			selections = append(selections, definition.SelectionSet.Selections...)
+		case *ast.FragmentDefinition:
+			selections = append(selections, definition.SelectionSet.Selections...)
+		}
+	}
+
+	for len(selections) > 0 {
+		selection := selections[0]
+		selections = selections[1:]
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if selection.Name.Value == "__schema" || selection.Name.Value == "__type" {
+				return true
+			}
+			if selection.SelectionSet != nil {
+				selections = append(selections, selection.SelectionSet.Selections...)
+			}
+		case *ast.InlineFragment:
+			selections = append(selections, selection.SelectionSet.Selections...)
+		}
+	}
+	return false
+}
+
+func queryScheme() (graphql.Schema, error) {
 	return graphql.NewSchema(graphql.SchemaConfig{
 		Query: graphql.NewObject(graphql.ObjectConfig{
 			Name: "Query",
 			Fields: graphql.Fields{
 				"person": &graphql.Field{
 					Type: models.GraphQLPersonType,
+					Args: graphql.FieldConfigArgument{
+						"id":   &graphql.ArgumentConfig{Type: graphql.Int},
+						"asOf": &graphql.ArgumentConfig{Type: graphql.DateTime},
+					},
 					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						store := storeFromContext(p.Context)
+						id, hasID := p.Args["id"].(int)
+						if hasID {
+							err := validateArgument("id", &models.Person{Id: int32(id)}, "id")
+							if err != nil {
+								return nil, err
+							}
+						}
+
+						if asOf, ok := p.Args["asOf"].(time.Time); ok {
+							if !featuresFromContext(p.Context).History {
+								return nil, errHistoryDisabled
+							}
+							if !hasID {
+								// without an id, go back in time on the person that is served by default
+								person, err := firstPerson(store)
+								if err != nil || person == nil {
+									return nil, err
+								}
+								id = int(person.Id)
+							}
+							return personAsOf(store, int32(id), asOf)
+						}
+
+						var person *models.Person
+						var err error
+						if hasID {
+							person, err = store.Person(int32(id))
+						} else {
+							person, err = firstPerson(store)
+						}
+						if err != nil || person == nil {
+							return nil, err
+						}
 						return person, nil
 					},
 				},
@@ -78,19 +522,3 @@ func queryScheme(person interface{}) (graphql.Schema, error) {
 		}),
 	})
 }
-
-func getData() (*models.Person, error) {
-	// retrieve the latest data
-	data, err := ioutil.ReadFile("data.bin")
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data: %v", err)
-	}
-
-	person := &models.Person{}
-	err = proto.Unmarshal(data, person)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data: %v", err)
-	}
-
-	return person, nil
-}
@@ -5,13 +5,16 @@ import (
 	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
 	"github.com/golang/protobuf/proto"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestQuery(t *testing.T) {
 	go main()
+	waitForServer(t, "http://localhost:8080/healthz")
 
 	query := []byte("{ name phone { number } }")
 	response, err := http.Post("http://localhost:8080/query", "application/json", bytes.NewBuffer(query))
@@ -30,6 +33,68 @@ func TestQuery(t *testing.T) {
 	}
 }
 
+func TestReadiness(t *testing.T) {
+	ready := &readiness{store: newFileStore("data.bin")}
+	if reasons := ready.check(); len(reasons) > 0 {
+		t.Fatalf("not ready: %v", reasons)
+	}
+
+	ready = &readiness{store: newFileStore("missing.bin")}
+	ready.drain()
+	if reasons := ready.check(); len(reasons) != 2 {
+		t.Fatalf("unexpected reasons: %v", reasons)
+	}
+}
+
+func TestShutdownDelay(t *testing.T) {
+	ready := &readiness{store: newFileStore("data.bin")}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(ready.handler)}
+	go server.Serve(listener)
+	url := "http://" + listener.Addr().String() + "/readyz"
+
+	config := defaultConfig()
+	config.ShutdownDelay = 500 * time.Millisecond
+	done := make(chan error, 1)
+	go func() { done <- shutdown(server, ready, config) }()
+
+	// the server reports not ready during the delay, so it's taken out of rotation
+	time.Sleep(100 * time.Millisecond)
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("server stopped accepting connections during the delay: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d during the delay", response.StatusCode)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = http.Get(url)
+	if err == nil {
+		t.Fatal("server accepts connections after shutdown")
+	}
+}
+
+// waitForServer waits until the server started by a test accepts requests.
+func waitForServer(t *testing.T, url string) {
+	for i := 0; i < 50; i++ {
+		response, err := http.Get(url)
+		if err == nil {
+			response.Body.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("server at %s didn't start", url)
+}
+
 func TestOutputData(t *testing.T) {
 	person := &models.Person{
 		Id:    32,
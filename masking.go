@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/gogo/protobuf/proto"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// masking policies, which decide how the fields with a mask are shown
+const (
+	// maskPolicy masks a field as declared in models.proto.
+	maskPolicy = "mask"
+	// hashPolicy replaces a field with its HMAC-SHA256 under the hash key, so records
+	// can still be joined, but values can't be found by hashing guesses.
+	hashPolicy = "hash"
+	// dropPolicy leaves a field out.
+	dropPolicy = "drop"
+)
+
+// minHashKeySize is the minimum size of the key of the hash policy.
+const minHashKeySize = 16
+
+// hashKey keys the hashes of the hash policy, which redacts the fields without it.
+var hashKey []byte
+
+// personMasks holds how the fields of a person are masked, partial or last4, by
+// the dotted path of the field.
+var personMasks = fieldOptions(&models.Person{}, models.E_Mask)
+
+// maskedPaths returns the paths of the fields with a mask, in order.
+func maskedPaths() []string {
+	paths := make([]string, 0, len(personMasks))
+	for path := range personMasks {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+type maskingKey struct{}
+
+func withMasking(ctx context.Context, masking Masking) context.Context {
+	return context.WithValue(ctx, maskingKey{}, masking)
+}
+
+// maskingPolicy returns the policy for the role of the caller, or an empty string
+// when the caller may not see the fields it isn't authorized for at all.
+func maskingPolicy(ctx context.Context) string {
+	masking, _ := ctx.Value(maskingKey{}).(Masking)
+	principal, _ := authorizing(ctx)
+	return masking.Roles[principal.Role()]
+}
+
+// maskValue returns the value of the field at path under a masking policy.
+func maskValue(policy, path, value string) string {
+	if value == "" {
+		return value
+	}
+	switch policy {
+	case hashPolicy:
+		if hashKey == nil {
+			return redacted
+		}
+		mac := hmac.New(sha256.New, hashKey)
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	case dropPolicy:
+		return ""
+	}
+
+	switch personMasks[path] {
+	case "partial":
+		return maskPartial(value)
+	case "last4":
+		return maskDigits(value, 4)
+	}
+	return redacted
+}
+
+// useHashKey keys the hashes of the hash policy with a secret, so equal values
+// have equal hashes, or turns the hashes off when the key is empty.
+func useHashKey(key string) error {
+	if key == "" {
+		hashKey = nil
+		return nil
+	}
+	if len(key) < minHashKeySize {
+		return errors.New("masking hash key must have at least 16 bytes")
+	}
+	hashKey = []byte(key)
+	return nil
+}
+
+// useCommandHashKey keys the hashes of a command with the key of its -hash-key flag,
+// or else with masking.hashKey of the configuration in GQLPB_CONFIG and the environment.
+func useCommandHashKey(key string) error {
+	if key == "" {
+		var err error
+		key, err = configValue("masking-hash-key")
+		if err != nil {
+			return fmt.Errorf("failed to read the masking hash key: %v", err)
+		}
+	}
+	if key == "" {
+		return errors.New("hashes need a masking hash key, set with -hash-key or masking.hashKey")
+	}
+	return useHashKey(key)
+}
+
+// maskField returns the resolved value of the field at path under a masking
+// policy, which is null when the field is dropped.
+func maskField(policy, path, value string) interface{} {
+	if policy == dropPolicy {
+		return nil
+	}
+	return maskValue(policy, path, value)
+}
+
+// maskPartial keeps the first character and the domain of an email address, as in j***@joosten.
+func maskPartial(value string) string {
+	first, _ := utf8.DecodeRuneInString(value)
+	masked := string(first) + "***"
+	if at := strings.LastIndex(value, "@"); at > 0 {
+		masked += value[at:]
+	}
+	return masked
+}
+
+// maskDigits replaces all but the last digits of a value, keeping the other characters.
+func maskDigits(value string, keep int) string {
+	digits := 0
+	for _, r := range value {
+		if unicode.IsDigit(r) {
+			digits++
+		}
+	}
+
+	var masked strings.Builder
+	for _, r := range value {
+		if unicode.IsDigit(r) {
+			digits--
+			if digits >= keep {
+				r = '*'
+			}
+		}
+		masked.WriteRune(r)
+	}
+	return masked.String()
+}
+
+// maskPerson returns a copy of a person with the fields that have a mask masked
+// under the policy.
+func maskPerson(policy string, person *models.Person) *models.Person {
+	masked := proto.Clone(person).(*models.Person)
+	for path := range personMasks {
+		field := protoField(reflect.ValueOf(masked), path)
+		if field.Kind() == reflect.String {
+			field.SetString(maskValue(policy, path, field.String()))
+		}
+	}
+	return masked
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testHashKey is the masking hash key of the tests.
+const testHashKey = "0123456789abcdef"
+
+// keyedHash returns the hash of a value under the hash policy with testHashKey.
+func keyedHash(value string) string {
+	mac := hmac.New(sha256.New, []byte(testHashKey))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestMaskValue(t *testing.T) {
+	err := useHashKey(testHashKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer useHashKey("")
+
+	for _, test := range []struct {
+		policy, path, value, expected string
+	}{
+		{maskPolicy, "email", "jaap@joosten", "j***@joosten"},
+		{maskPolicy, "email", "jaap", "j***"},
+		{maskPolicy, "phone.number", "053218622189", "********2189"},
+		{maskPolicy, "phone.number", "+31 6 1234 5678", "+** * **** 5678"},
+		{maskPolicy, "name", "Jaap Joosten", redacted},
+		{maskPolicy, "email", "", ""},
+		{hashPolicy, "email", "jaap@joosten", keyedHash("jaap@joosten")},
+		{dropPolicy, "email", "jaap@joosten", ""},
+	} {
+		masked := maskValue(test.policy, test.path, test.value)
+		if masked != test.expected {
+			t.Fatalf("%s of %s %q is %q, expected %q", test.policy, test.path, test.value, masked, test.expected)
+		}
+	}
+
+	// the same value has the same hash under a key, so records can be joined, but
+	// not the hash of the value alone
+	if maskValue(hashPolicy, "email", "jaap@joosten") != maskValue(hashPolicy, "phone.number", "jaap@joosten") {
+		t.Fatal("equal values have different hashes")
+	}
+	if maskValue(hashPolicy, "email", "jaap@joosten") == queryHash("jaap@joosten") {
+		t.Fatal("value hashed without the key")
+	}
+	if useHashKey("short") == nil {
+		t.Fatal("short hash key accepted")
+	}
+	useHashKey("")
+	if masked := maskValue(hashPolicy, "email", "jaap@joosten"); masked != redacted {
+		t.Fatalf("value hashed without a key as %q", masked)
+	}
+}
+
+func TestMaskPerson(t *testing.T) {
+	person := &models.Person{Id: 32, Name: "Jaap Joosten", Email: "jaap@joosten", Phone: &models.PhoneNumber{Number: "053218622189", Type: models.PhoneType_HOME}}
+	masked := maskPerson(maskPolicy, person)
+	expected := &models.Person{Id: 32, Name: "Jaap Joosten", Email: "j***@joosten", Phone: &models.PhoneNumber{Number: "********2189", Type: models.PhoneType_HOME}}
+	if !masked.Equal(expected) || person.Email != "jaap@joosten" {
+		t.Fatalf("unexpected masked person %v of %v", masked, person)
+	}
+
+	masked = maskPerson(dropPolicy, &models.Person{Id: 33, Email: "anna@joosten"})
+	if !masked.Equal(&models.Person{Id: 33}) {
+		t.Fatalf("unexpected masked person %v", masked)
+	}
+}
+
+func TestMaskedFields(t *testing.T) {
+	auth, err := authenticate(Auth{APIKeys: []APIKey{
+		{Key: "support", Subject: "support", Claims: map[string]interface{}{"role": "support"}},
+		{Key: "analytics", Subject: "analytics", Claims: map[string]interface{}{"role": "analytics"}},
+		{Key: "marketing", Subject: "marketing", Claims: map[string]interface{}{"role": "marketing"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig()
+	config.Masking.Roles = map[string]string{"support": maskPolicy, "analytics": hashPolicy, "marketing": dropPolicy}
+	err = useHashKey(testHashKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer useHashKey("")
+	handler := auth(queryHandler(newFileStore("data.bin"), config, nil))
+
+	for key, expected := range map[string]string{
+		"support":   `{"person":{"email":"j***@joosten","phone":{"number":"********2189"}}}`,
+		"analytics": `{"person":{"email":"` + keyedHash("jaap@joosten") + `","phone":{"number":"` + keyedHash("053218622189") + `"}}}`,
+		"marketing": `{"person":{"email":null,"phone":{"number":null}}}`,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person { email phone { number } } }"}`))
+		request.Header.Set(apiKeyHeader, key)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		if response.Code != http.StatusOK || response.Body.String() != expected+"\n" {
+			t.Fatalf("%s: unexpected response %d: %s", key, response.Code, response.Body)
+		}
+	}
+}
+
+func TestMaskedVariables(t *testing.T) {
+	variables := map[string]interface{}{"email": "jaap@joosten", "filter": map[string]interface{}{"phone": map[string]interface{}{"number": "053218622189"}}, "token": "secret"}
+	logged := redactVariables(variables, []string{"email", "phone.number", "token"}, "", true)
+	expected := map[string]interface{}{"email": "j***@joosten", "filter": map[string]interface{}{"phone": map[string]interface{}{"number": "********2189"}}, "token": redacted}
+	if !reflect.DeepEqual(logged, expected) {
+		t.Fatalf("unexpected variables %v, expected %v", logged, expected)
+	}
+}
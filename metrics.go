@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/graphql-go/graphql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+// outcomes of a GraphQL request
+const (
+	outcomeSuccess         = "success"
+	outcomeSchemaError     = "schema_error"
+	outcomeParseError      = "parse_error"
+	outcomeRejected        = "rejected"
+	outcomeValidationError = "validation_error"
+	outcomeExecutionError  = "execution_error"
+)
+
+var (
+	queryRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_requests_total",
+		Help: "GraphQL requests by operation name and outcome.",
+	}, []string{"operation", "outcome"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "graphql_request_duration_seconds",
+		Help:    "Duration of GraphQL requests by operation name and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "outcome"})
+
+	resolverDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "graphql_resolver_duration_seconds",
+		Help:    "Duration of field resolvers by type and field.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"type", "field"})
+
+	dataLoadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "data_load_duration_seconds",
+		Help:    "Duration of loading data files by outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	dataLoadSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "data_load_bytes",
+		Help:    "Size of the loaded data files.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+
+	persistedQueryLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_persisted_queries_total",
+		Help: "Persisted queries by result: hit, miss, registered or rejected.",
+	}, []string{"result"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_cache_lookups_total",
+		Help: "Lookups in the schema and parse caches by result, hit or miss.",
+	}, []string{"cache", "result"})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_rate_limited_total",
+		Help: "Rate limited requests by tier and code, RATE_LIMITED or COST_QUOTA_EXCEEDED.",
+	}, []string{"tier", "code"})
+)
+
+// operation labels of requests without a name of their own
+const (
+	operationAnonymous = "anonymous"
+	// operationInvalid labels requests that fail before their document is valid.
+	operationInvalid = "invalid"
+	// operationOther labels the operations after the first maxOperationLabels names.
+	operationOther = "other"
+)
+
+// maxOperationLabels bounds the number of operation names that label metrics, as
+// the names are chosen by the clients.
+const maxOperationLabels = 100
+
+var operationLabels = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// operationLabel returns the label of an operation of a valid document, which is
+// its name while there are fewer than maxOperationLabels names.
+func operationLabel(name string) string {
+	if name == "" {
+		return operationAnonymous
+	}
+	operationLabels.Lock()
+	defer operationLabels.Unlock()
+	if !operationLabels.names[name] {
+		if len(operationLabels.names) >= maxOperationLabels {
+			return operationOther
+		}
+		operationLabels.names[name] = true
+	}
+	return name
+}
+
+// observeQuery counts a request by its operation label, see operationLabel.
+func observeQuery(operation, outcome string, start time.Time) {
+	queryRequests.WithLabelValues(operation, outcome).Inc()
+	queryDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+}
+
+func observeDataLoad(size int64, start time.Time, err error) {
+	outcome := outcomeSuccess
+	if err != nil && err != errStop {
+		outcome = "error"
+	}
+	dataLoadDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	if size >= 0 {
+		dataLoadSize.Observe(float64(size))
+	}
+}
+
+func observePersistedQuery(result string) {
+	persistedQueryLookups.WithLabelValues(result).Inc()
+}
+
+func observeCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+func observeRateLimited(tier, code string) {
+	rateLimited.WithLabelValues(tier, code).Inc()
+}
+
+// timeResolvers measures the duration of the resolvers of an object's fields.
+func timeResolvers(object *graphql.Object) {
+	wrapResolvers(object, func(name string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+		observer := resolverDuration.WithLabelValues(object.Name(), name)
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			start := time.Now()
+			defer func() {
+				observer.Observe(time.Since(start).Seconds())
+			}()
+			return resolve(p)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+)
+
+func TestQueryMetrics(t *testing.T) {
+	requests := queryRequests.WithLabelValues("Name", outcomeSuccess)
+	invalid := queryRequests.WithLabelValues(operationInvalid, outcomeValidationError)
+	hits := cacheLookups.WithLabelValues("parse", "hit")
+	before := []float64{testutil.ToFloat64(requests), testutil.ToFloat64(invalid), testutil.ToFloat64(hits)}
+
+	store := newFileStore("data.bin")
+	for i := 0; i < 2; i++ {
+		_, err := execute(context.Background(), queryRequest{Query: "query Name { person { name } }"}, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := execute(context.Background(), queryRequest{Query: "{ person { unknown } }"}, store)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	after := []float64{testutil.ToFloat64(requests), testutil.ToFloat64(invalid), testutil.ToFloat64(hits)}
+	if after[0]-before[0] != 2 || after[1]-before[1] != 1 || after[2]-before[2] < 1 {
+		t.Fatalf("unexpected metrics %v, before %v", after, before)
+	}
+
+	// operation names that aren't in a valid document don't label the metrics
+	_, err = execute(context.Background(), queryRequest{Query: "{ person { name } }", OperationName: "Unknown"}, store)
+	if err == nil {
+		t.Fatal("expected unknown operation error")
+	}
+	if testutil.ToFloat64(queryRequests.WithLabelValues("Unknown", outcomeExecutionError)) != 0 {
+		t.Fatal("unknown operation name used as a label")
+	}
+	defer func(names map[string]bool) { operationLabels.names = names }(operationLabels.names)
+	operationLabels.names = map[string]bool{"Name": true}
+	for len(operationLabels.names) < maxOperationLabels {
+		operationLabel(fmt.Sprintf("Operation%d", len(operationLabels.names)))
+	}
+	if label := operationLabel("Another"); label != operationOther {
+		t.Fatalf("unexpected label %s", label)
+	}
+
+	if testutil.CollectAndCount(resolverDuration) == 0 {
+		t.Fatal("resolver durations not observed")
+	}
+	if testutil.CollectAndCount(dataLoadDuration) == 0 {
+		t.Fatal("data loads not observed")
+	}
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Change is a difference in a single field between two versions of a message.
+type Change struct {
+	// Path is the dotted path of the field, using the field names in models.proto.
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+// Diff returns the fields that differ between two versions of a person, walking
+// into nested messages. A nil person is compared as an empty person.
+func Diff(a, b *Person) []Change {
+	return diffMessage("", reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+func diffMessage(prefix string, a, b reflect.Value) []Change {
+	messageType := a.Type().Elem()
+	a = messageValue(a)
+	b = messageValue(b)
+
+	var changes []Change
+	for i := 0; i < messageType.NumField(); i++ {
+		field := messageType.Field(i)
+		name := protoName(field)
+		if name == "" {
+			continue
+		}
+
+		path := prefix + name
+		oldValue, newValue := a.Field(i), b.Field(i)
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			if !oldValue.IsNil() || !newValue.IsNil() {
+				changes = append(changes, diffMessage(path+".", oldValue, newValue)...)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+			changes = append(changes, Change{Path: path, Old: oldValue.Interface(), New: newValue.Interface()})
+		}
+	}
+	return changes
+}
+
+// messageValue returns the struct a message pointer points to, or an empty struct for nil.
+func messageValue(message reflect.Value) reflect.Value {
+	if message.IsNil() {
+		return reflect.New(message.Type().Elem()).Elem()
+	}
+	return message.Elem()
+}
+
+// protoName returns the name of a field in the proto definition, or an empty
+// string for fields that aren't part of it.
+func protoName(field reflect.StructField) string {
+	for _, option := range strings.Split(field.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(option, "name=") {
+			return strings.TrimPrefix(option, "name=")
+		}
+	}
+	return ""
+}
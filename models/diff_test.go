@@ -0,0 +1,45 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := &Person{
+		Id:    32,
+		Name:  "Jaap Joosten",
+		Email: "jaap@joosten",
+		Phone: &PhoneNumber{Number: "053218622189", Type: PhoneType_HOME},
+	}
+	new := &Person{
+		Id:    32,
+		Name:  "Jaap Joosten",
+		Email: "jaap@example.com",
+		Phone: &PhoneNumber{Number: "0612345678", Type: PhoneType_MOBILE},
+	}
+
+	expected := []Change{
+		{Path: "email", Old: "jaap@joosten", New: "jaap@example.com"},
+		{Path: "phone.number", Old: "053218622189", New: "0612345678"},
+		{Path: "phone.type", Old: PhoneType_HOME, New: PhoneType_MOBILE},
+	}
+	if changes := Diff(old, new); !reflect.DeepEqual(expected, changes) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	if changes := Diff(old, old); len(changes) != 0 {
+		t.Fatalf("unexpected changes between equal people: %v", changes)
+	}
+
+	expected = []Change{
+		{Path: "name", Old: "", New: "Jaap Joosten"},
+		{Path: "id", Old: int32(0), New: int32(32)},
+		{Path: "email", Old: "", New: "jaap@joosten"},
+		{Path: "phone.number", Old: "", New: "053218622189"},
+		{Path: "phone.type", Old: PhoneType_MOBILE, New: PhoneType_HOME},
+	}
+	if changes := Diff(nil, old); !reflect.DeepEqual(expected, changes) {
+		t.Fatalf("unexpected changes from nil: %v", changes)
+	}
+}
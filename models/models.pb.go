@@ -8,6 +8,7 @@ import (
 	fmt "fmt"
 	_ "github.com/bi-foundation/protobuf-graphql-extension/graphqlproto"
 	proto "github.com/gogo/protobuf/proto"
+	descriptor "github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
 	github_com_graphql_go_graphql "github.com/graphql-go/graphql"
 	io "io"
 	math "math"
@@ -179,35 +180,143 @@ func (m *PhoneNumber) GetType() PhoneType {
 	return PhoneType_MOBILE
 }
 
+var E_Auth = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*string)(nil),
+	Field:         50001,
+	Name:          "models.auth",
+	Tag:           "bytes,50001,opt,name=auth",
+	Filename:      "models.proto",
+}
+
+var E_Mask = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*string)(nil),
+	Field:         50002,
+	Name:          "models.mask",
+	Tag:           "bytes,50002,opt,name=mask",
+	Filename:      "models.proto",
+}
+
+var E_Required = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*bool)(nil),
+	Field:         50003,
+	Name:          "models.required",
+	Tag:           "varint,50003,opt,name=required",
+	Filename:      "models.proto",
+}
+
+var E_Pattern = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*string)(nil),
+	Field:         50004,
+	Name:          "models.pattern",
+	Tag:           "bytes,50004,opt,name=pattern",
+	Filename:      "models.proto",
+}
+
+var E_MinLen = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*int64)(nil),
+	Field:         50005,
+	Name:          "models.min_len",
+	Tag:           "varint,50005,opt,name=min_len,json=minLen",
+	Filename:      "models.proto",
+}
+
+var E_MaxLen = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*int64)(nil),
+	Field:         50006,
+	Name:          "models.max_len",
+	Tag:           "varint,50006,opt,name=max_len,json=maxLen",
+	Filename:      "models.proto",
+}
+
+var E_Min = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*float64)(nil),
+	Field:         50007,
+	Name:          "models.min",
+	Tag:           "fixed64,50007,opt,name=min",
+	Filename:      "models.proto",
+}
+
+var E_Max = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*float64)(nil),
+	Field:         50008,
+	Name:          "models.max",
+	Tag:           "fixed64,50008,opt,name=max",
+	Filename:      "models.proto",
+}
+
+var E_DefinedOnly = &proto.ExtensionDesc{
+	ExtendedType:  (*descriptor.FieldOptions)(nil),
+	ExtensionType: (*bool)(nil),
+	Field:         50009,
+	Name:          "models.defined_only",
+	Tag:           "varint,50009,opt,name=defined_only,json=definedOnly",
+	Filename:      "models.proto",
+}
+
 func init() {
 	proto.RegisterEnum("models.PhoneType", PhoneType_name, PhoneType_value)
 	proto.RegisterType((*Person)(nil), "models.Person")
 	proto.RegisterType((*PhoneNumber)(nil), "models.PhoneNumber")
+	proto.RegisterExtension(E_Auth)
+	proto.RegisterExtension(E_Mask)
+	proto.RegisterExtension(E_Required)
+	proto.RegisterExtension(E_Pattern)
+	proto.RegisterExtension(E_MinLen)
+	proto.RegisterExtension(E_MaxLen)
+	proto.RegisterExtension(E_Min)
+	proto.RegisterExtension(E_Max)
+	proto.RegisterExtension(E_DefinedOnly)
 }
 
 func init() { proto.RegisterFile("models.proto", fileDescriptor_0b5431a010549573) }
 
 var fileDescriptor_0b5431a010549573 = []byte{
-	// 299 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x54, 0x90, 0x4f, 0x4a, 0xc3, 0x40,
-	0x14, 0xc6, 0x7d, 0x31, 0x0d, 0xf6, 0x55, 0x4a, 0x1d, 0x45, 0x82, 0xc8, 0x58, 0x0a, 0x42, 0x55,
-	0xda, 0x42, 0xbd, 0x41, 0xa1, 0xa0, 0xd8, 0x36, 0x25, 0x08, 0xae, 0x13, 0x33, 0x6d, 0x06, 0x32,
-	0x33, 0x31, 0x7f, 0xc0, 0x5e, 0xc7, 0x95, 0x47, 0x70, 0xe9, 0xd2, 0xa5, 0x47, 0xd0, 0x9c, 0xc2,
-	0xa5, 0x64, 0x12, 0x45, 0x77, 0xdf, 0xf7, 0x7b, 0x3f, 0xde, 0x1b, 0x06, 0x77, 0x85, 0x0a, 0x58,
-	0x94, 0x0e, 0xe3, 0x44, 0x65, 0x8a, 0x58, 0x55, 0x3b, 0x5a, 0xac, 0x79, 0x16, 0xe6, 0xfe, 0xf0,
-	0x5e, 0x89, 0x91, 0xcf, 0x07, 0x2b, 0x95, 0xcb, 0xc0, 0xcb, 0xb8, 0x92, 0x23, 0xed, 0xf9, 0xf9,
-	0x6a, 0xb0, 0x4e, 0xbc, 0x38, 0x7c, 0x88, 0x06, 0xec, 0x31, 0x63, 0x32, 0x2d, 0x47, 0x35, 0xd1,
-	0xc6, 0x4f, 0xa9, 0xf6, 0xf6, 0x04, 0x5a, 0x4b, 0x96, 0xa4, 0x4a, 0x12, 0x82, 0xa6, 0xf4, 0x04,
-	0xb3, 0xa1, 0x0b, 0xfd, 0xa6, 0xab, 0x33, 0x69, 0xa3, 0xc1, 0x03, 0xdb, 0xe8, 0x42, 0xbf, 0xe1,
-	0x1a, 0x3c, 0x20, 0x07, 0xd8, 0x60, 0xc2, 0xe3, 0x91, 0xbd, 0xad, 0xa5, 0xaa, 0x90, 0x33, 0x6c,
-	0xc4, 0xa1, 0x92, 0xcc, 0x36, 0xbb, 0xd0, 0x6f, 0x8d, 0xf7, 0x87, 0xf5, 0xcb, 0x97, 0x25, 0x5c,
-	0xe4, 0xc2, 0x67, 0x89, 0x5b, 0x19, 0xbd, 0x19, 0xb6, 0xfe, 0x50, 0x72, 0x88, 0x96, 0xd4, 0xa9,
-	0xbe, 0x5a, 0x37, 0x72, 0x8a, 0x66, 0xb6, 0x89, 0x99, 0xbe, 0xdc, 0x1e, 0xef, 0xfd, 0x5b, 0x78,
-	0xbb, 0x89, 0x99, 0xab, 0xc7, 0xe7, 0x17, 0xd8, 0xfc, 0x45, 0x04, 0xd1, 0x9a, 0x3b, 0x93, 0xeb,
-	0xd9, 0xb4, 0xb3, 0x45, 0x76, 0xd0, 0xbc, 0x72, 0xe6, 0xd3, 0x0e, 0x94, 0xe9, 0xce, 0x71, 0x6f,
-	0x3a, 0xc6, 0xe4, 0xf8, 0xeb, 0x93, 0xc2, 0x73, 0x41, 0xe1, 0xa5, 0xa0, 0xf0, 0x56, 0x50, 0x78,
-	0x2f, 0x28, 0x7c, 0x14, 0x14, 0x5e, 0x9f, 0x4e, 0xc0, 0xb7, 0xf4, 0x77, 0x5c, 0x7e, 0x07, 0x00,
-	0x00, 0xff, 0xff, 0x4c, 0x47, 0x4b, 0x73, 0x76, 0x01, 0x00, 0x00,
+	// 580 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0xd1, 0xbd, 0x6f, 0xd3, 0x4c,
+	0x1c, 0x07, 0xf0, 0x5e, 0xea, 0xb8, 0xe9, 0xa5, 0x7a, 0x9e, 0x60, 0x96, 0x53, 0x29, 0x26, 0xaa,
+	0x3a, 0x14, 0xa2, 0x38, 0xd0, 0x32, 0x50, 0x33, 0xb4, 0xb2, 0x14, 0x04, 0xa2, 0x6d, 0x2a, 0x0b,
+	0x89, 0xa1, 0x6a, 0xaa, 0x4b, 0x7d, 0x49, 0x4e, 0xd8, 0x77, 0xae, 0x5f, 0xa4, 0x64, 0x64, 0x61,
+	0x60, 0x64, 0x62, 0xce, 0xd4, 0x31, 0xcb, 0x49, 0xb0, 0x31, 0x76, 0xe4, 0xfd, 0x65, 0x83, 0xfc,
+	0x05, 0x8c, 0x4c, 0x08, 0xf9, 0xec, 0x44, 0xc0, 0x62, 0xbc, 0xf8, 0xee, 0x77, 0xdf, 0xcf, 0xf9,
+	0x7c, 0x3f, 0xb8, 0xe4, 0x71, 0x87, 0xb8, 0xa1, 0xe1, 0x07, 0x3c, 0xe2, 0x9a, 0x9a, 0xce, 0x96,
+	0xf7, 0x7b, 0x34, 0xea, 0xc7, 0x1d, 0xe3, 0x84, 0x7b, 0x8d, 0x0e, 0xad, 0x77, 0x79, 0xcc, 0x1c,
+	0x1c, 0x51, 0xce, 0x1a, 0x32, 0xd7, 0x89, 0xbb, 0xf5, 0x5e, 0x80, 0xfd, 0xfe, 0xa9, 0x5b, 0x27,
+	0x83, 0x88, 0xb0, 0x30, 0x59, 0xca, 0x2a, 0x32, 0x31, 0x9d, 0xa4, 0xfb, 0x2e, 0x57, 0x7b, 0x9c,
+	0xf7, 0x5c, 0x32, 0xd3, 0x0d, 0x87, 0x84, 0x27, 0x01, 0xf5, 0x23, 0x1e, 0xa4, 0x89, 0x55, 0x01,
+	0xa0, 0x7a, 0x40, 0x82, 0x90, 0x33, 0x6d, 0x05, 0x2a, 0x0c, 0x7b, 0x04, 0x81, 0x2a, 0x58, 0x5f,
+	0xb4, 0x4a, 0xcf, 0x05, 0x02, 0x63, 0x81, 0x1c, 0x5b, 0x56, 0xb5, 0x4b, 0xb0, 0x40, 0x1d, 0x54,
+	0xa8, 0x82, 0xf5, 0xa2, 0x55, 0x7e, 0x29, 0xd0, 0x9c, 0x7c, 0xbe, 0x6f, 0xdb, 0x05, 0xea, 0x68,
+	0x4d, 0x58, 0x24, 0x1e, 0xa6, 0x2e, 0x9a, 0x97, 0xb6, 0xf1, 0x54, 0xa0, 0x92, 0x4f, 0xa9, 0x19,
+	0x10, 0xec, 0x3c, 0x13, 0x68, 0xc1, 0xc7, 0x41, 0x44, 0xb1, 0x3b, 0x12, 0xe8, 0xff, 0xf6, 0x61,
+	0x7b, 0xa7, 0x7a, 0x54, 0xdb, 0x49, 0x5f, 0x6b, 0x63, 0x81, 0x7e, 0x02, 0x3b, 0xd5, 0xda, 0x55,
+	0x58, 0xf4, 0xfb, 0x9c, 0x11, 0xa4, 0x54, 0xc1, 0x7a, 0x79, 0xe3, 0xa2, 0x91, 0x5d, 0xd2, 0x41,
+	0x52, 0xdc, 0x8f, 0xbd, 0x0e, 0x09, 0xec, 0x34, 0xb1, 0xfa, 0x18, 0xc0, 0xf2, 0x6f, 0x65, 0xad,
+	0x09, 0x55, 0x26, 0x47, 0xd9, 0xf1, 0xeb, 0x7f, 0x1d, 0xa1, 0xe8, 0xe2, 0x30, 0xba, 0x39, 0x12,
+	0x68, 0xa9, 0x7d, 0x58, 0x3b, 0xda, 0x3e, 0xbc, 0x5e, 0xdf, 0x3a, 0xaa, 0xad, 0x9d, 0x09, 0xa4,
+	0x8c, 0x05, 0xaa, 0xd8, 0x19, 0xd6, 0x6a, 0x50, 0x89, 0x86, 0x3e, 0x91, 0xff, 0xf9, 0xdf, 0xc6,
+	0x85, 0x3f, 0x0e, 0xf0, 0x60, 0xe8, 0x13, 0x4b, 0x39, 0x17, 0x08, 0xd8, 0x32, 0x74, 0xad, 0x06,
+	0x17, 0x67, 0x0b, 0x1a, 0x84, 0xea, 0x5e, 0xcb, 0xba, 0xb7, 0xdb, 0xac, 0xcc, 0x69, 0x25, 0xa8,
+	0xdc, 0x6d, 0xed, 0x35, 0x2b, 0x20, 0x19, 0x3d, 0x6c, 0xd9, 0xf7, 0x2b, 0x05, 0x73, 0x13, 0x2a,
+	0x38, 0x8e, 0xfa, 0xda, 0x65, 0x23, 0xed, 0x89, 0x31, 0xed, 0x89, 0x71, 0x87, 0x12, 0xd7, 0x69,
+	0xf9, 0x49, 0x9b, 0x43, 0xf4, 0xe6, 0x89, 0xbc, 0x42, 0x5b, 0x86, 0x13, 0xe4, 0xe1, 0xf0, 0x51,
+	0x1e, 0x7a, 0x3b, 0x45, 0x49, 0xd8, 0xbc, 0x0d, 0x4b, 0x01, 0x39, 0x8d, 0x69, 0x40, 0x9c, 0x3c,
+	0xf8, 0x4e, 0xc2, 0x92, 0x3d, 0x03, 0xe6, 0x16, 0x5c, 0xf0, 0x71, 0x14, 0x91, 0x80, 0xe5, 0xd9,
+	0xf7, 0xd9, 0x47, 0xa7, 0x79, 0xf3, 0x16, 0x5c, 0xf0, 0x28, 0x3b, 0x76, 0x49, 0x2e, 0xfd, 0x20,
+	0xe9, 0xbc, 0xad, 0x7a, 0x94, 0xed, 0x92, 0x54, 0xe2, 0xc1, 0xbf, 0xc8, 0x8f, 0x33, 0x89, 0x07,
+	0x89, 0xbc, 0x01, 0xe7, 0x3d, 0x9a, 0xab, 0x3e, 0x49, 0x05, 0xec, 0x24, 0x2b, 0x09, 0x1e, 0xe4,
+	0x91, 0xcf, 0x33, 0x82, 0x07, 0xa6, 0x05, 0x97, 0x1c, 0xd2, 0xa5, 0x8c, 0x38, 0xc7, 0x9c, 0xb9,
+	0xc3, 0x3c, 0xfb, 0x25, 0xbb, 0xd5, 0x72, 0x86, 0x5a, 0xcc, 0x1d, 0x5a, 0x2b, 0x3f, 0xbe, 0xe9,
+	0xe0, 0x6c, 0xa2, 0x83, 0x17, 0x13, 0x1d, 0x9c, 0x4f, 0x74, 0xf0, 0x7a, 0xa2, 0x83, 0xaf, 0x13,
+	0x1d, 0xbc, 0x1a, 0x5d, 0x01, 0x1d, 0x55, 0xee, 0xb4, 0xf9, 0x6b, 0x00, 0xd0, 0x3b, 0x62, 0x37,
+	0x17, 0x04, 0x00, 0x00,
 }
 
 func (this *Person) Equal(that interface{}) bool {
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"fmt"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// FieldError is a field that breaks a validation rule in models.proto.
+type FieldError struct {
+	// Path is the dotted path of the field, using the field names in models.proto.
+	Path string
+	// Rule is the name of the field option that is broken, like required or max_len.
+	Rule    string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationError holds all fields of a message that break a validation rule.
+type ValidationError struct {
+	Fields []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Error()
+	}
+	return "invalid " + strings.Join(messages, ", ")
+}
+
+// Field returns the error of the field at path, or nil when the field is valid.
+func (e *ValidationError) Field(path string) *FieldError {
+	for _, field := range e.Fields {
+		if field.Path == path {
+			return field
+		}
+	}
+	return nil
+}
+
+// Validate checks the person and its phone number against the validation rules
+// in models.proto.
+func (m *Person) Validate() error {
+	return validate(m)
+}
+
+// Validate checks the phone number against the validation rules in models.proto.
+func (m *PhoneNumber) Validate() error {
+	return validate(m)
+}
+
+func validate(message descriptor.Message) error {
+	fields := validateMessage("", message)
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// fieldRules are the validation rules of a single field.
+type fieldRules struct {
+	required    bool
+	pattern     *regexp.Regexp
+	minLen      *int64
+	maxLen      *int64
+	min         *float64
+	max         *float64
+	definedOnly map[int32]string
+}
+
+var rulesCache = struct {
+	sync.Mutex
+	types map[reflect.Type]map[int]*fieldRules
+}{types: make(map[reflect.Type]map[int]*fieldRules)}
+
+// messageRules returns the validation rules of the fields of a message type by
+// their index in the Go struct, which are read from its descriptor once.
+func messageRules(message descriptor.Message) map[int]*fieldRules {
+	messageType := reflect.TypeOf(message).Elem()
+	rulesCache.Lock()
+	defer rulesCache.Unlock()
+	if rules, ok := rulesCache.types[messageType]; ok {
+		return rules
+	}
+
+	_, root := descriptor.ForMessage(message)
+	fields := make(map[string]*descriptor.FieldDescriptorProto)
+	for _, field := range root.Field {
+		fields[field.GetName()] = field
+	}
+
+	rules := make(map[int]*fieldRules)
+	for i := 0; i < messageType.NumField(); i++ {
+		field, ok := fields[protoName(messageType.Field(i))]
+		if !ok || field.Options == nil {
+			continue
+		}
+		r := &fieldRules{}
+		if value, err := proto.GetExtension(field.Options, E_Required); err == nil {
+			r.required = *value.(*bool)
+		}
+		if value, err := proto.GetExtension(field.Options, E_Pattern); err == nil {
+			r.pattern = regexp.MustCompile(*value.(*string))
+		}
+		if value, err := proto.GetExtension(field.Options, E_MinLen); err == nil {
+			r.minLen = value.(*int64)
+		}
+		if value, err := proto.GetExtension(field.Options, E_MaxLen); err == nil {
+			r.maxLen = value.(*int64)
+		}
+		if value, err := proto.GetExtension(field.Options, E_Min); err == nil {
+			r.min = value.(*float64)
+		}
+		if value, err := proto.GetExtension(field.Options, E_Max); err == nil {
+			r.max = value.(*float64)
+		}
+		if value, err := proto.GetExtension(field.Options, E_DefinedOnly); err == nil && *value.(*bool) {
+			r.definedOnly = make(map[int32]string)
+			for name, number := range proto.EnumValueMap(strings.TrimPrefix(field.GetTypeName(), ".")) {
+				r.definedOnly[number] = name
+			}
+		}
+		rules[i] = r
+	}
+	rulesCache.types[messageType] = rules
+	return rules
+}
+
+// validateMessage returns the fields of a message that break a rule, walking into
+// the nested messages that are set.
+func validateMessage(prefix string, message descriptor.Message) []*FieldError {
+	value := reflect.ValueOf(message).Elem()
+	rules := messageRules(message)
+
+	var errors []*FieldError
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		path := prefix + protoName(value.Type().Field(i))
+		if r, ok := rules[i]; ok {
+			if err := r.check(field); err != nil {
+				err.Path = path
+				errors = append(errors, err)
+			}
+		}
+		if field.Kind() == reflect.Ptr && !field.IsNil() {
+			if nested, ok := field.Interface().(descriptor.Message); ok {
+				errors = append(errors, validateMessage(path+".", nested)...)
+			}
+		}
+	}
+	return errors
+}
+
+// check returns the first rule a field value breaks. Empty strings are only
+// checked for required.
+func (r *fieldRules) check(field reflect.Value) *FieldError {
+	if r.required && field.IsZero() {
+		return &FieldError{Rule: "required", Message: "is required"}
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		value := field.String()
+		if value == "" {
+			return nil
+		}
+		length := int64(utf8.RuneCountInString(value))
+		if r.minLen != nil && length < *r.minLen {
+			return &FieldError{Rule: "min_len", Message: fmt.Sprintf("must be at least %d characters", *r.minLen)}
+		}
+		if r.maxLen != nil && length > *r.maxLen {
+			return &FieldError{Rule: "max_len", Message: fmt.Sprintf("must be at most %d characters", *r.maxLen)}
+		}
+		if r.pattern != nil && !r.pattern.MatchString(value) {
+			return &FieldError{Rule: "pattern", Message: fmt.Sprintf("must match %s", r.pattern)}
+		}
+
+	case reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		if r.definedOnly != nil {
+			if _, ok := r.definedOnly[int32(field.Int())]; !ok {
+				return &FieldError{Rule: "defined_only", Message: fmt.Sprintf("%d is not a defined value", field.Int())}
+			}
+			return nil
+		}
+		var value float64
+		if field.Kind() == reflect.Float32 || field.Kind() == reflect.Float64 {
+			value = field.Float()
+		} else {
+			value = float64(field.Int())
+		}
+		if r.min != nil && value < *r.min {
+			return &FieldError{Rule: "min", Message: fmt.Sprintf("must be at least %v", *r.min)}
+		}
+		if r.max != nil && value > *r.max {
+			return &FieldError{Rule: "max", Message: fmt.Sprintf("must be at most %v", *r.max)}
+		}
+	}
+	return nil
+}
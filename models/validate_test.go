@@ -0,0 +1,52 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := &Person{
+		Id:    32,
+		Name:  "Jaap Joosten",
+		Email: "jaap@joosten",
+		Phone: &PhoneNumber{Number: "+3153218622189", Type: PhoneType_HOME},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid person refused: %v", err)
+	}
+	// empty strings are only checked for required
+	if err := (&Person{Id: 33, Name: "Anna Joosten", Phone: &PhoneNumber{}}).Validate(); err != nil {
+		t.Fatalf("valid person refused: %v", err)
+	}
+
+	invalid := &Person{
+		Id:    0,
+		Email: "jaap",
+		Phone: &PhoneNumber{Number: "053", Type: PhoneType(7)},
+	}
+	err, ok := invalid.Validate().(*ValidationError)
+	if !ok {
+		t.Fatalf("invalid person accepted: %v", err)
+	}
+	expected := map[string]string{
+		"name":         "required",
+		"id":           "min",
+		"email":        "pattern",
+		"phone.number": "min_len",
+		"phone.type":   "defined_only",
+	}
+	if len(err.Fields) != len(expected) {
+		t.Fatalf("unexpected errors %v", err)
+	}
+	for path, rule := range expected {
+		if field := err.Field(path); field == nil || field.Rule != rule {
+			t.Fatalf("unexpected error of %s: %v", path, field)
+		}
+	}
+
+	err, ok = (&Person{Id: 32, Name: strings.Repeat("a", 101)}).Validate().(*ValidationError)
+	if !ok || err.Field("name").Rule != "max_len" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
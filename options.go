@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"reflect"
+	"strings"
+)
+
+// fieldOptions returns the values of a string field option in models.proto for
+// the fields of a message and the messages it holds, by the dotted path of the field.
+func fieldOptions(message descriptor.Message, option *proto.ExtensionDesc) map[string]string {
+	file, root := descriptor.ForMessage(message)
+	messages := make(map[string]*descriptor.DescriptorProto)
+	for _, m := range file.MessageType {
+		messages["."+file.GetPackage()+"."+m.GetName()] = m
+	}
+
+	values := make(map[string]string)
+	var walk func(message *descriptor.DescriptorProto, prefix string)
+	walk = func(message *descriptor.DescriptorProto, prefix string) {
+		for _, field := range message.Field {
+			path := prefix + field.GetName()
+			if field.Options != nil {
+				if value, err := proto.GetExtension(field.Options, option); err == nil {
+					values[path] = *value.(*string)
+				}
+			}
+			if nested, ok := messages[field.GetTypeName()]; ok && field.IsMessage() {
+				walk(nested, path+".")
+			}
+		}
+	}
+	walk(root, "")
+	return values
+}
+
+// protoField returns the field at a dotted path of a message, using the field names
+// in models.proto, or the zero value when a message on the path is nil.
+func protoField(message reflect.Value, path string) reflect.Value {
+	field := message
+	for _, name := range strings.Split(path, ".") {
+		if field.Kind() != reflect.Ptr || field.IsNil() {
+			return reflect.Value{}
+		}
+		message := field.Elem()
+		field = reflect.Value{}
+		for i := 0; i < message.NumField(); i++ {
+			if strings.Contains(message.Type().Field(i).Tag.Get("protobuf")+",", ",name="+name+",") {
+				field = message.Field(i)
+			}
+		}
+	}
+	return field
+}
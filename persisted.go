@@ -0,0 +1,169 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// persistedQuery is the persisted query extension of Apollo clients, which send the
+// hash of a query instead of the query.
+type persistedQuery struct {
+	Version    int    `json:"version"`
+	SHA256Hash string `json:"sha256Hash"`
+}
+
+// persistedQueries resolves the queries that clients send by hash. Queries are
+// registered by clients that send the hash with the query, the automatic persisted
+// queries flow, or loaded from a manifest. In strict mode only the queries in the
+// manifest are executed.
+type persistedQueries struct {
+	strict bool
+	// manifest holds the queries of the manifest by hash, which are never evicted.
+	manifest map[string]string
+
+	mu         sync.Mutex
+	size       int
+	order      *list.List
+	registered map[string]*list.Element
+}
+
+type registeredQuery struct {
+	hash  string
+	query string
+}
+
+func newPersistedQueries(config PersistedQueries) (*persistedQueries, error) {
+	if config.Mode == "off" {
+		return nil, nil
+	}
+
+	p := &persistedQueries{
+		strict:     config.Mode == "strict",
+		manifest:   make(map[string]string),
+		size:       int(config.CacheSize),
+		order:      list.New(),
+		registered: make(map[string]*list.Element),
+	}
+	if config.Manifest != "" {
+		manifest, err := loadManifest(config.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		p.manifest = manifest
+	}
+	return p, nil
+}
+
+// loadManifest reads a manifest of queries by hash, in the format of the Apollo
+// persisted query manifest or as a JSON object of queries by hash.
+func loadManifest(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	var apollo struct {
+		Operations []struct {
+			ID   string `json:"id"`
+			Body string `json:"body"`
+		} `json:"operations"`
+	}
+	queries := make(map[string]string)
+	err = json.Unmarshal(data, &apollo)
+	if err == nil && apollo.Operations != nil {
+		for _, operation := range apollo.Operations {
+			queries[operation.ID] = operation.Body
+		}
+	} else if err = json.Unmarshal(data, &queries); err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %v", path, err)
+	}
+
+	manifest := make(map[string]string, len(queries))
+	for hash, query := range queries {
+		if strings.ToLower(hash) != queryHash(query) {
+			return nil, fmt.Errorf("failed to read manifest %s: hash %s doesn't match its query", path, hash)
+		}
+		manifest[strings.ToLower(hash)] = query
+	}
+	return manifest, nil
+}
+
+// resolve sets the query of a request that is sent by hash, registers the query of
+// a request that is sent with its hash and checks the query against the manifest
+// in strict mode.
+func (p *persistedQueries) resolve(request *queryRequest) *queryError {
+	hash := ""
+	if request.Extensions.PersistedQuery != nil {
+		hash = strings.ToLower(request.Extensions.PersistedQuery.SHA256Hash)
+	}
+
+	if request.Query == "" {
+		query, ok := p.lookup(hash)
+		if !ok {
+			observePersistedQuery("miss")
+			return persistedQueryError("PERSISTED_QUERY_NOT_FOUND", "PersistedQueryNotFound")
+		}
+		observePersistedQuery("hit")
+		request.Query = query
+		return nil
+	}
+
+	actual := queryHash(request.Query)
+	if hash != "" && hash != actual {
+		return persistedQueryError("PERSISTED_QUERY_HASH_MISMATCH", "provided sha does not match query")
+	}
+	if p.strict {
+		if _, ok := p.manifest[actual]; !ok {
+			observePersistedQuery("rejected")
+			return persistedQueryError("PERSISTED_QUERY_NOT_ALLOWED", "query is not in the persisted query manifest")
+		}
+		return nil
+	}
+	if hash != "" {
+		observePersistedQuery("registered")
+		p.register(hash, request.Query)
+	}
+	return nil
+}
+
+func (p *persistedQueries) lookup(hash string) (string, bool) {
+	if query, ok := p.manifest[hash]; ok {
+		return query, true
+	}
+	if p.strict {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	element, ok := p.registered[hash]
+	if !ok {
+		return "", false
+	}
+	p.order.MoveToFront(element)
+	return element.Value.(*registeredQuery).query, true
+}
+
+func (p *persistedQueries) register(hash, query string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.registered[hash]; ok {
+		return
+	}
+	p.registered[hash] = p.order.PushFront(&registeredQuery{hash: hash, query: query})
+	if p.order.Len() > p.size {
+		oldest := p.order.Remove(p.order.Back()).(*registeredQuery)
+		delete(p.registered, oldest.hash)
+	}
+}
+
+func persistedQueryError(code, message string) *queryError {
+	return newQueryError(code, fmt.Errorf("failed to execute graphql operation: %s", message), gqlerrors.FormatErrors(errors.New(message)))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAutomaticPersistedQueries(t *testing.T) {
+	persisted, err := newPersistedQueries(PersistedQueries{Mode: "apq", CacheSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := queryHandler(newFileStore("data.bin"), defaultConfig(), persisted)
+
+	query := "{ person { name } }"
+	byHash := fmt.Sprintf(`{"extensions": {"persistedQuery": {"version": 1, "sha256Hash": %q}}}`, queryHash(query))
+	withQuery := fmt.Sprintf(`{"query": %q, "extensions": {"persistedQuery": {"version": 1, "sha256Hash": %q}}}`, query, queryHash(query))
+
+	status, body := post(handler, byHash)
+	if status != http.StatusBadRequest || errorCode(t, body) != "PERSISTED_QUERY_NOT_FOUND" {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+	status, body = post(handler, withQuery)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+	status, body = post(handler, byHash)
+	if status != http.StatusOK || body != `{"person":{"name":"Jaap Joosten"}}`+"\n" {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+
+	mismatch := fmt.Sprintf(`{"query": "{ person { id } }", "extensions": {"persistedQuery": {"version": 1, "sha256Hash": %q}}}`, queryHash(query))
+	status, body = post(handler, mismatch)
+	if status != http.StatusBadRequest || errorCode(t, body) != "PERSISTED_QUERY_HASH_MISMATCH" {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+}
+
+func TestStrictPersistedQueries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	query := "{ person { name } }"
+	manifest := filepath.Join(dir, "manifest.json")
+	err := ioutil.WriteFile(manifest, []byte(fmt.Sprintf(`{"format": "apollo-persisted-query-manifest", "version": 1, "operations": [{"id": %q, "name": "Name", "type": "query", "body": %q}]}`, queryHash(query), query)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	persisted, err := newPersistedQueries(PersistedQueries{Mode: "strict", Manifest: manifest, CacheSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := queryHandler(newFileStore("data.bin"), defaultConfig(), persisted)
+
+	status, body := post(handler, fmt.Sprintf(`{"extensions": {"persistedQuery": {"version": 1, "sha256Hash": %q}}}`, queryHash(query)))
+	if status != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+	status, body = post(handler, fmt.Sprintf(`{"query": %q}`, query))
+	if status != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+	status, body = post(handler, `{"query": "{ person { email } }"}`)
+	if status != http.StatusBadRequest || errorCode(t, body) != "PERSISTED_QUERY_NOT_ALLOWED" {
+		t.Fatalf("unexpected response %d: %s", status, body)
+	}
+
+	err = ioutil.WriteFile(manifest, []byte(fmt.Sprintf(`{%q: "{ person { email } }"}`, queryHash(query))), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newPersistedQueries(PersistedQueries{Mode: "strict", Manifest: manifest, CacheSize: 10})
+	if err == nil {
+		t.Fatal("expected a manifest with a wrong hash to be rejected")
+	}
+}
+
+func post(handler http.Handler, body string) (int, string) {
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(body)))
+	return response.Code, response.Body.String()
+}
+
+func errorCode(t *testing.T, body string) interface{} {
+	var response struct {
+		Errors []struct {
+			Extensions map[string]interface{} `json:"extensions"`
+		} `json:"errors"`
+	}
+	err := json.Unmarshal([]byte(body), &response)
+	if err != nil || len(response.Errors) == 0 {
+		t.Fatalf("response without errors: %s", body)
+	}
+	return response.Errors[0].Extensions["code"]
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/graphql-go/graphql"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// phoneRegion is the numbering plan of a region, as far as it's needed to
+// normalize and format its phone numbers.
+type phoneRegion struct {
+	// name is the ISO 3166 code of the region.
+	name string
+	// code is the country calling code.
+	code string
+	// trunk is the prefix of national numbers, which isn't part of the number in E.164.
+	trunk string
+	// dialedTrunk is set when the trunk prefix is dialed, but not written in the
+	// national format, like in the NANP.
+	dialedTrunk bool
+	// international is the prefix that dials out of the region.
+	international string
+	// minLength and maxLength are the number of digits of numbers without trunk prefix.
+	minLength, maxLength int
+	layouts              []phoneLayout
+}
+
+// phoneLayout groups the digits of numbers with a prefix and length; a # is a digit.
+type phoneLayout struct {
+	// prefixes are the prefixes of the numbers in the layout, which holds for all
+	// numbers of its length when there are none.
+	prefixes []string
+	length   int
+	layout   string
+}
+
+// nlAreaCodes are the Dutch area codes of two digits. The other geographic numbers
+// have area codes of three digits.
+var nlAreaCodes = []string{
+	"10", "13", "15", "20", "23", "24", "26", "30", "33", "35", "36", "38", "40", "43", "45",
+	"46", "50", "53", "55", "58", "70", "71", "72", "73", "74", "75", "76", "77", "78", "79",
+}
+
+// phoneRegions is the embedded metadata of the supported regions. Regions that
+// share a calling code are looked up by the first of them.
+var phoneRegions = []*phoneRegion{
+	{name: "NL", code: "31", trunk: "0", international: "00", minLength: 9, maxLength: 11, layouts: []phoneLayout{
+		{prefixes: []string{"6"}, length: 9, layout: "# ########"},
+		{prefixes: nlAreaCodes, length: 9, layout: "## #######"},
+		{prefixes: []string{"1", "2", "3", "4", "5", "7"}, length: 9, layout: "### ######"},
+	}},
+	{name: "BE", code: "32", trunk: "0", international: "00", minLength: 8, maxLength: 9, layouts: []phoneLayout{
+		{prefixes: []string{"4"}, length: 9, layout: "### ## ## ##"},
+		{length: 8, layout: "# ### ## ##"},
+	}},
+	{name: "DE", code: "49", trunk: "0", international: "00", minLength: 6, maxLength: 13},
+	{name: "FR", code: "33", trunk: "0", international: "00", minLength: 9, maxLength: 9, layouts: []phoneLayout{
+		{length: 9, layout: "# ## ## ## ##"},
+	}},
+	{name: "GB", code: "44", trunk: "0", international: "00", minLength: 9, maxLength: 10, layouts: []phoneLayout{
+		{prefixes: []string{"7"}, length: 10, layout: "#### ######"},
+	}},
+	{name: "US", code: "1", trunk: "1", dialedTrunk: true, international: "011", minLength: 10, maxLength: 10, layouts: []phoneLayout{
+		{length: 10, layout: "(###) ###-####"},
+	}},
+	{name: "CA", code: "1", trunk: "1", dialedTrunk: true, international: "011", minLength: 10, maxLength: 10, layouts: []phoneLayout{
+		{length: 10, layout: "(###) ###-####"},
+	}},
+	{name: "ES", code: "34", international: "00", minLength: 9, maxLength: 9},
+	// Italian numbers keep their leading 0 in E.164.
+	{name: "IT", code: "39", international: "00", minLength: 6, maxLength: 11},
+	{name: "CH", code: "41", trunk: "0", international: "00", minLength: 9, maxLength: 9},
+	{name: "AT", code: "43", trunk: "0", international: "00", minLength: 4, maxLength: 13},
+	{name: "AU", code: "61", trunk: "0", international: "0011", minLength: 9, maxLength: 9},
+}
+
+// phoneDefaultRegion is the region of phone numbers without a calling code, or nil
+// when they can't be normalized.
+var phoneDefaultRegion = findPhoneRegion("NL")
+
+// findPhoneRegion returns the region with an ISO 3166 code, or nil when it isn't supported.
+func findPhoneRegion(name string) *phoneRegion {
+	for _, region := range phoneRegions {
+		if region.name == strings.ToUpper(name) {
+			return region
+		}
+	}
+	return nil
+}
+
+// addPhoneRegionFlag adds the -region flag of a command, which defaults to
+// phone.defaultRegion of the configuration in GQLPB_CONFIG and the environment.
+// Only the region is read, so the rest of the configuration needn't be valid.
+func addPhoneRegionFlag(flags *flag.FlagSet) *string {
+	region, err := configValue("phone-default-region")
+	if err != nil {
+		region = defaultConfig().Phone.DefaultRegion
+		log.Printf("failed to read the phone region of the configuration, using %q: %v", region, err)
+	}
+	return flags.String("region", region, "region of phone numbers without a country calling code, empty to refuse them")
+}
+
+// usePhoneRegion normalizes phone numbers without a calling code as numbers of the
+// given region, or refuses them when the region is empty.
+func usePhoneRegion(name string) error {
+	if name == "" {
+		phoneDefaultRegion = nil
+		return nil
+	}
+	region := findPhoneRegion(name)
+	if region == nil {
+		return fmt.Errorf("unsupported phone region %q", name)
+	}
+	phoneDefaultRegion = region
+	return nil
+}
+
+// phoneNumber is a parsed phone number: the digits after the calling code of its region.
+type phoneNumber struct {
+	region *phoneRegion
+	digits string
+}
+
+// parsePhone parses a phone number with a calling code, after a + or the
+// international prefix of the default region, or a national number of the default region.
+func parsePhone(number string, region *phoneRegion) (*phoneNumber, error) {
+	digits := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" -.()/", r) {
+			return -1
+		}
+		return r
+	}, number)
+	international := strings.HasPrefix(digits, "+")
+	digits = strings.TrimPrefix(digits, "+")
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return nil, fmt.Errorf("%q is not a phone number", number)
+	}
+
+	if !international && region != nil && strings.HasPrefix(digits, region.international) {
+		digits, international = strings.TrimPrefix(digits, region.international), true
+	}
+	if international {
+		region = nil
+		for _, candidate := range phoneRegions {
+			if strings.HasPrefix(digits, candidate.code) {
+				region = candidate
+				break
+			}
+		}
+		if region == nil {
+			return nil, fmt.Errorf("%q has an unknown country calling code", number)
+		}
+		digits = strings.TrimPrefix(digits, region.code)
+	} else {
+		if region == nil {
+			return nil, fmt.Errorf("%q has no country calling code", number)
+		}
+		digits = strings.TrimPrefix(digits, region.trunk)
+	}
+
+	if len(digits) < region.minLength || len(digits) > region.maxLength {
+		return nil, fmt.Errorf("%q has an invalid length for region %s", number, region.name)
+	}
+	return &phoneNumber{region: region, digits: digits}, nil
+}
+
+// e164 returns the number as + and the calling code and number, without separators.
+func (n *phoneNumber) e164() string {
+	return "+" + n.region.code + n.digits
+}
+
+// national returns the number as it is written within its region.
+func (n *phoneNumber) national() string {
+	if n.region.dialedTrunk {
+		return n.grouped()
+	}
+	return n.region.trunk + n.grouped()
+}
+
+// international returns the number as it is written for other regions.
+func (n *phoneNumber) international() string {
+	grouped := strings.NewReplacer("(", "", ")", "").Replace(n.grouped())
+	return "+" + n.region.code + " " + grouped
+}
+
+func (n *phoneNumber) countryCode() int {
+	code, _ := strconv.Atoi(n.region.code)
+	return code
+}
+
+// grouped returns the digits in the layout of the region, or as they are when no
+// layout applies.
+func (n *phoneNumber) grouped() string {
+	for _, layout := range n.region.layouts {
+		if !layout.matches(n.digits) {
+			continue
+		}
+		var grouped strings.Builder
+		next := 0
+		for _, r := range layout.layout {
+			if r == '#' {
+				grouped.WriteByte(n.digits[next])
+				next++
+			} else {
+				grouped.WriteRune(r)
+			}
+		}
+		return grouped.String()
+	}
+	return n.digits
+}
+
+func (l phoneLayout) matches(digits string) bool {
+	if l.length != len(digits) {
+		return false
+	}
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(digits, prefix) {
+			return true
+		}
+	}
+	return len(l.prefixes) == 0
+}
+
+// normalizePerson prepares a person to be stored: its phone number is normalized
+// to E.164 and the person is validated.
+func normalizePerson(person *models.Person) error {
+	if person.Phone != nil && person.Phone.Number != "" {
+		number, err := parsePhone(person.Phone.Number, phoneDefaultRegion)
+		if err != nil {
+			return fmt.Errorf("invalid phone.number: %v", err)
+		}
+		person.Phone.Number = number.e164()
+	}
+	return person.Validate()
+}
+
+// phoneFields are the fields of a phone number that are computed from its number,
+// which are authorized and masked like the number.
+var phoneFields = map[string]string{
+	"phone.e164":        "phone.number",
+	"phone.national":    "phone.number",
+	"phone.countryCode": "phone.number",
+}
+
+const (
+	phoneFormatE164          = "E164"
+	phoneFormatNational      = "NATIONAL"
+	phoneFormatInternational = "INTERNATIONAL"
+)
+
+var phoneFormatEnum = graphql.NewEnum(graphql.EnumConfig{
+	Name:        "PhoneFormat",
+	Description: "How a phone number is formatted.",
+	Values: graphql.EnumValueConfigMap{
+		phoneFormatE164:          &graphql.EnumValueConfig{Value: phoneFormatE164, Description: "+ and the country calling code and number, like +31532186221."},
+		phoneFormatNational:      &graphql.EnumValueConfig{Value: phoneFormatNational, Description: "As written within the region, like 053 2186221."},
+		phoneFormatInternational: &graphql.EnumValueConfig{Value: phoneFormatInternational, Description: "As written for other regions, like +31 53 2186221."},
+	},
+})
+
+func init() {
+	addField(models.GraphQLPhoneNumberType, "number", &graphql.Field{
+		Type:        graphql.String,
+		Description: "The number as it is stored, or in the given format.",
+		Args: graphql.FieldConfigArgument{
+			"format": &graphql.ArgumentConfig{Type: phoneFormatEnum},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			format, ok := p.Args["format"].(string)
+			if !ok {
+				phone, _ := p.Source.(*models.PhoneNumber)
+				if phone == nil {
+					return nil, fmt.Errorf("field number not resolved")
+				}
+				return phone.Number, nil
+			}
+			return resolvePhone(p, func(number *phoneNumber) interface{} {
+				switch format {
+				case phoneFormatNational:
+					return number.national()
+				case phoneFormatInternational:
+					return number.international()
+				}
+				return number.e164()
+			})
+		},
+	})
+	addField(models.GraphQLPhoneNumberType, "e164", &graphql.Field{
+		Type:        graphql.String,
+		Description: "The number in E.164, or null when it isn't a valid number.",
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return resolvePhone(p, func(number *phoneNumber) interface{} { return number.e164() })
+		},
+	})
+	addField(models.GraphQLPhoneNumberType, "national", &graphql.Field{
+		Type:        graphql.String,
+		Description: "The number as written within its region, or null when it isn't a valid number.",
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return resolvePhone(p, func(number *phoneNumber) interface{} { return number.national() })
+		},
+	})
+	addField(models.GraphQLPhoneNumberType, "countryCode", &graphql.Field{
+		Type:        graphql.Int,
+		Description: "The country calling code of the number, or null when it isn't a valid number.",
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return resolvePhone(p, func(number *phoneNumber) interface{} { return number.countryCode() })
+		},
+	})
+}
+
+// resolvePhone resolves a field computed from a phone number. Numbers stored before
+// they were normalized are parsed in the default region; numbers that don't parse
+// resolve to null.
+func resolvePhone(p graphql.ResolveParams, value func(number *phoneNumber) interface{}) (interface{}, error) {
+	phone, _ := p.Source.(*models.PhoneNumber)
+	if phone == nil {
+		return nil, fmt.Errorf("field %s not resolved", p.Info.FieldName)
+	}
+	number, err := parsePhone(phone.Number, phoneDefaultRegion)
+	if err != nil {
+		return nil, nil
+	}
+	return value(number), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePhone(t *testing.T) {
+	nl, us := findPhoneRegion("NL"), findPhoneRegion("us")
+	for _, test := range []struct {
+		number                        string
+		region                        *phoneRegion
+		e164, national, international string
+		countryCode                   int
+	}{
+		{"053 2186221", nl, "+31532186221", "053 2186221", "+31 53 2186221", 31},
+		{"06-12345678", nl, "+31612345678", "06 12345678", "+31 6 12345678", 31},
+		{"0031 6 12345678", nl, "+31612345678", "06 12345678", "+31 6 12345678", 31},
+		{"053218622189", nl, "+3153218622189", "053218622189", "+31 53218622189", 31},
+		{"0591 234567", nl, "+31591234567", "0591 234567", "+31 591 234567", 31},
+		{"020-1234567", nl, "+31201234567", "020 1234567", "+31 20 1234567", 31},
+		{"085 123 4567", nl, "+31851234567", "0851234567", "+31 851234567", 31},
+		{"(201) 555-0123", us, "+12015550123", "(201) 555-0123", "+1 201 555-0123", 1},
+		{"+32 470 12 34 56", us, "+32470123456", "0470 12 34 56", "+32 470 12 34 56", 32},
+		{"+33 1 23 45 67 89", nil, "+33123456789", "01 23 45 67 89", "+33 1 23 45 67 89", 33},
+	} {
+		number, err := parsePhone(test.number, test.region)
+		if err != nil {
+			t.Fatalf("%s: %v", test.number, err)
+		}
+		if number.e164() != test.e164 || number.national() != test.national || number.international() != test.international || number.countryCode() != test.countryCode {
+			t.Fatalf("%s: unexpected %s, %s, %s, %d", test.number, number.e164(), number.national(), number.international(), number.countryCode())
+		}
+	}
+
+	for _, number := range []string{"", "053 218 x", "0612", "+999 12345678", "+31 6 1234"} {
+		if _, err := parsePhone(number, nl); err == nil {
+			t.Fatalf("%q parsed", number)
+		}
+	}
+	if _, err := parsePhone("0612345678", nil); err == nil {
+		t.Fatal("national number parsed without a region")
+	}
+}
+
+func TestPhoneRegionFlag(t *testing.T) {
+	region := addPhoneRegionFlag(flag.NewFlagSet("test", flag.ContinueOnError))
+	if *region != defaultConfig().Phone.DefaultRegion {
+		t.Fatalf("unexpected default region %q", *region)
+	}
+
+	os.Setenv("GQLPB_PHONE_DEFAULT_REGION", "BE")
+	region = addPhoneRegionFlag(flag.NewFlagSet("test", flag.ContinueOnError))
+	os.Unsetenv("GQLPB_PHONE_DEFAULT_REGION")
+	if *region != "BE" {
+		t.Fatalf("region of the configuration not used: %q", *region)
+	}
+
+	// only the region is read, from a configuration that doesn't validate
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	err := ioutil.WriteFile(path, []byte("listen: nowhere\nphone:\n  defaultRegion: FR\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GQLPB_CONFIG", path)
+	os.Setenv("GQLPB_READ_TIMEOUT", "never")
+	region = addPhoneRegionFlag(flag.NewFlagSet("test", flag.ContinueOnError))
+	os.Unsetenv("GQLPB_CONFIG")
+	os.Unsetenv("GQLPB_READ_TIMEOUT")
+	if *region != "FR" {
+		t.Fatalf("region of the configuration file not used: %q", *region)
+	}
+}
+
+func TestPhoneFields(t *testing.T) {
+	auth, err := authenticate(Auth{APIKeys: []APIKey{
+		{Key: "support", Subject: "support", Scopes: []string{"pii:read"}},
+		{Key: "analytics", Subject: "analytics", Claims: map[string]interface{}{"role": "support"}},
+		{Key: "auditor", Subject: "auditor", Claims: map[string]interface{}{"role": "auditor"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := defaultConfig()
+	config.Masking.Roles = map[string]string{"support": maskPolicy, "auditor": hashPolicy}
+	err = useHashKey(testHashKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer useHashKey("")
+	handler := auth(queryHandler(newFileStore("data.bin"), config, nil))
+
+	query := "{ person { phone { number e164 national countryCode international: number(format: INTERNATIONAL) } } }"
+	for key, expected := range map[string]string{
+		"support":   `{"person":{"phone":{"countryCode":31,"e164":"+3153218622189","international":"+31 53218622189","national":"053218622189","number":"053218622189"}}}`,
+		"auditor":   `{"person":{"phone":{"countryCode":null,"e164":"` + keyedHash("+3153218622189") + `","international":"` + keyedHash("+31 53218622189") + `","national":"` + keyedHash("053218622189") + `","number":"` + keyedHash("053218622189") + `"}}}`,
+		"analytics": `{"person":{"phone":{"countryCode":null,"e164":"+*********2189","international":"+** *******2189","national":"********2189","number":"********2189"}}}`,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "`+query+`"}`))
+		request.Header.Set(apiKeyHeader, key)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		if response.Code != http.StatusOK || response.Body.String() != expected+"\n" {
+			t.Fatalf("%s: unexpected response %d: %s", key, response.Code, response.Body)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// rowPolicy decides which people a caller can see. Its rules are expressions over
+// the fields of a person and the caller, such as
+//
+//	person.email endsWith "@joosten" && principal.team in ["support", "sales"]
+//
+// A person is visible when any rule holds. Fields of a person are named by their
+// path in models.proto, and principal.subject, principal.scopes and the claims of
+// the caller by their name. Rules compare values with ==, !=, <, <=, >, >=, in,
+// contains, startsWith and endsWith, and combine them with &&, || and !.
+type rowPolicy []ruleExpression
+
+// compilePolicy compiles the rules of a row policy. Without rules, all people
+// are visible.
+func compilePolicy(rules []string) (rowPolicy, error) {
+	policy := make(rowPolicy, 0, len(rules))
+	for _, rule := range rules {
+		expression, err := parseRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy rule %q: %v", rule, err)
+		}
+		policy = append(policy, expression)
+	}
+	return policy, nil
+}
+
+// allows reports whether the principal, nil for anonymous callers, can see the person.
+func (p rowPolicy) allows(person *models.Person, principal *Principal) bool {
+	if len(p) == 0 {
+		return true
+	}
+	env := &policyEnv{person: reflect.ValueOf(person), principal: principal}
+	for _, rule := range p {
+		if rule.eval(env) == true {
+			return true
+		}
+	}
+	return false
+}
+
+type policyKey struct{}
+
+func withPolicy(ctx context.Context, policy rowPolicy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// restrictStore returns the store of a request, which only holds the people the
+// caller can see. Like the fields, people aren't restricted when the server has
+// no credentials configured, nor for the query command.
+func restrictStore(ctx context.Context, store PersonStore) PersonStore {
+	policy, _ := ctx.Value(policyKey{}).(rowPolicy)
+	principal, checked := authorizing(ctx)
+	if len(policy) == 0 || !checked {
+		return store
+	}
+	return &policyStore{store: store, allows: func(person *models.Person) bool {
+		return policy.allows(person, principal)
+	}}
+}
+
+var errPolicyDenied = errors.New("not allowed by the access policy")
+
+// policyStore hides the people that a caller isn't allowed to see, as if they
+// aren't stored.
+type policyStore struct {
+	store  PersonStore
+	allows func(person *models.Person) bool
+}
+
+func (s *policyStore) Person(id int32) (*models.Person, error) {
+	person, err := s.store.Person(id)
+	if err != nil || person == nil || !s.allows(person) {
+		return nil, err
+	}
+	return person, nil
+}
+
+func (s *policyStore) ForEach(fn func(person *models.Person) error) error {
+	return s.store.ForEach(func(person *models.Person) error {
+		if !s.allows(person) {
+			return nil
+		}
+		return fn(person)
+	})
+}
+
+func (s *policyStore) Put(people ...*models.Person) error {
+	for _, person := range people {
+		if !s.allows(person) {
+			return fmt.Errorf("failed to store person %d: %v", person.Id, errPolicyDenied)
+		}
+	}
+	return s.store.Put(people...)
+}
+
+func (s *policyStore) Delete(id int32) error {
+	person, err := s.Person(id)
+	if err != nil {
+		return err
+	}
+	if person == nil {
+		return fmt.Errorf("failed to delete person %d: %v", id, errPolicyDenied)
+	}
+	return s.store.Delete(id)
+}
+
+// History returns the versions of a person that the caller can see, and the
+// deletions between them.
+func (s *policyStore) History(id int32) ([]Version, error) {
+	versions, err := s.store.History(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var visible []Version
+	seen := false
+	for _, version := range versions {
+		if version.Person != nil && !s.allows(version.Person) {
+			continue
+		}
+		seen = seen || version.Person != nil
+		visible = append(visible, version)
+	}
+	if !seen {
+		return nil, nil
+	}
+	return visible, nil
+}
+
+func (s *policyStore) Close() error {
+	return s.store.Close()
+}
+
+// policyEnv is what the rules of a policy are evaluated against.
+type policyEnv struct {
+	person    reflect.Value
+	principal *Principal
+}
+
+// ruleExpression is a compiled rule, or a part of it.
+type ruleExpression interface {
+	eval(env *policyEnv) interface{}
+}
+
+type ruleLiteral struct {
+	value interface{}
+}
+
+func (e ruleLiteral) eval(env *policyEnv) interface{} {
+	return e.value
+}
+
+type ruleList []ruleExpression
+
+func (e ruleList) eval(env *policyEnv) interface{} {
+	values := make([]interface{}, len(e))
+	for i, element := range e {
+		values[i] = element.eval(env)
+	}
+	return values
+}
+
+// personField is a field of the person, by its path in models.proto.
+type personField string
+
+func (e personField) eval(env *policyEnv) interface{} {
+	return policyValue(protoField(env.person, string(e)))
+}
+
+// principalField is the subject, the scopes or a claim of the caller.
+type principalField string
+
+func (e principalField) eval(env *policyEnv) interface{} {
+	if env.principal == nil {
+		return nil
+	}
+	switch e {
+	case "subject":
+		return env.principal.Subject
+	case "scopes":
+		scopes := make([]interface{}, len(env.principal.Scopes))
+		for i, scope := range env.principal.Scopes {
+			scopes[i] = scope
+		}
+		return scopes
+	}
+	return env.principal.Claims[string(e)]
+}
+
+type ruleNot struct {
+	operand ruleExpression
+}
+
+func (e ruleNot) eval(env *policyEnv) interface{} {
+	return e.operand.eval(env) != true
+}
+
+type ruleBinary struct {
+	operator    string
+	left, right ruleExpression
+}
+
+func (e ruleBinary) eval(env *policyEnv) interface{} {
+	switch e.operator {
+	case "&&":
+		return e.left.eval(env) == true && e.right.eval(env) == true
+	case "||":
+		return e.left.eval(env) == true || e.right.eval(env) == true
+	}
+
+	left, right := e.left.eval(env), e.right.eval(env)
+	switch e.operator {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	case "in":
+		return contains(right, left)
+	case "contains":
+		return contains(left, right)
+	case "startsWith", "endsWith":
+		l, ok := left.(string)
+		r, ok2 := right.(string)
+		if !ok || !ok2 {
+			return false
+		}
+		if e.operator == "startsWith" {
+			return strings.HasPrefix(l, r)
+		}
+		return strings.HasSuffix(l, r)
+	}
+
+	order, ok := compare(left, right)
+	if !ok {
+		return false
+	}
+	switch e.operator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+	return order >= 0
+}
+
+// policyValue converts a field of a person to a value of a rule: enums are
+// compared by name and numbers as float64, like the numbers in claims.
+func policyValue(field reflect.Value) interface{} {
+	if !field.IsValid() {
+		return nil
+	}
+	if stringer, ok := field.Interface().(fmt.Stringer); ok && field.Kind() == reflect.Int32 {
+		return stringer.String()
+	}
+	switch field.Kind() {
+	case reflect.String:
+		return field.String()
+	case reflect.Bool:
+		return field.Bool()
+	case reflect.Int32, reflect.Int64:
+		return float64(field.Int())
+	case reflect.Uint32, reflect.Uint64:
+		return float64(field.Uint())
+	case reflect.Float32, reflect.Float64:
+		return field.Float()
+	}
+	return nil
+}
+
+func equal(a, b interface{}) bool {
+	if order, ok := compare(a, b); ok {
+		return order == 0
+	}
+	if x, ok := a.(bool); ok {
+		y, ok := b.(bool)
+		return ok && x == y
+	}
+	return a == nil && b == nil
+}
+
+// compare orders two numbers or two strings.
+func compare(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		switch {
+		case !ok:
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	}
+	return 0, false
+}
+
+// contains reports whether a list holds a value, or a string a substring.
+func contains(collection, value interface{}) bool {
+	switch c := collection.(type) {
+	case []interface{}:
+		for _, element := range c {
+			if equal(element, value) {
+				return true
+			}
+		}
+	case string:
+		s, ok := value.(string)
+		return ok && strings.Contains(c, s)
+	}
+	return false
+}
+
+// policy rules are parsed by precedence:
+//
+//	rule       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ operator operand ]
+//	operand    = "(" rule ")" | "[" [ operand { "," operand } ] "]" | string | number | true | false | null | field
+type ruleParser struct {
+	tokens []string
+	pos    int
+}
+
+var comparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true, "contains": true, "startsWith": true, "endsWith": true}
+
+func parseRule(rule string) (ruleExpression, error) {
+	tokens, err := tokenize(rule)
+	if err != nil {
+		return nil, err
+	}
+	p := &ruleParser{tokens: tokens}
+	expression, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != "" {
+		return nil, fmt.Errorf("unexpected %s", p.peek())
+	}
+	return expression, nil
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *ruleParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *ruleParser) expect(token string) error {
+	if next := p.next(); next != token {
+		if next == "" {
+			next = "end of rule"
+		}
+		return fmt.Errorf("expected %s, found %s", token, next)
+	}
+	return nil
+}
+
+func (p *ruleParser) or() (ruleExpression, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right ruleExpression
+		right, err = p.and()
+		left = ruleBinary{operator: "||", left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *ruleParser) and() (ruleExpression, error) {
+	left, err := p.unary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right ruleExpression
+		right, err = p.unary()
+		left = ruleBinary{operator: "&&", left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *ruleParser) unary() (ruleExpression, error) {
+	if p.peek() == "!" {
+		p.next()
+		operand, err := p.unary()
+		return ruleNot{operand: operand}, err
+	}
+
+	left, err := p.operand()
+	if err != nil || !comparisons[p.peek()] {
+		return left, err
+	}
+	operator := p.next()
+	right, err := p.operand()
+	return ruleBinary{operator: operator, left: left, right: right}, err
+}
+
+func (p *ruleParser) operand() (ruleExpression, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, errors.New("unexpected end of rule")
+	case token == "(":
+		expression, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return expression, p.expect(")")
+	case token == "[":
+		var elements ruleList
+		for p.peek() != "]" {
+			if len(elements) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			element, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+		p.next()
+		return elements, nil
+	case token[0] == '"' || token[0] == '\'':
+		return ruleLiteral{value: token[1 : len(token)-1]}, nil
+	case token == "true" || token == "false":
+		return ruleLiteral{value: token == "true"}, nil
+	case token == "null":
+		return ruleLiteral{value: nil}, nil
+	case strings.HasPrefix(token, "person."):
+		path := strings.TrimPrefix(token, "person.")
+		if policyValue(protoField(reflect.ValueOf(&models.Person{Phone: &models.PhoneNumber{}}), path)) == nil {
+			return nil, fmt.Errorf("unknown field %s", token)
+		}
+		return personField(path), nil
+	case strings.HasPrefix(token, "principal."):
+		return principalField(strings.TrimPrefix(token, "principal.")), nil
+	}
+
+	number, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected %s", token)
+	}
+	return ruleLiteral{value: number}, nil
+}
+
+// tokenize splits a rule into operators, quoted strings, numbers and names.
+func tokenize(rule string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(rule); {
+		c := rule[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(rule[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, rule[i:i+end+2])
+			i += end + 2
+		case strings.HasPrefix(rule[i:], "&&") || strings.HasPrefix(rule[i:], "||") || strings.HasPrefix(rule[i:], "==") ||
+			strings.HasPrefix(rule[i:], "!=") || strings.HasPrefix(rule[i:], "<=") || strings.HasPrefix(rule[i:], ">="):
+			tokens = append(tokens, rule[i:i+2])
+			i += 2
+		case strings.IndexByte("!<>()[],", c) >= 0:
+			tokens = append(tokens, rule[i:i+1])
+			i++
+		default:
+			start := i
+			for i < len(rule) && (unicode.IsLetter(rune(rule[i])) || unicode.IsDigit(rune(rule[i])) || strings.IndexByte("_.-:", rule[i]) >= 0) {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("unexpected %q", rule[i])
+			}
+			tokens = append(tokens, rule[start:i])
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyRules(t *testing.T) {
+	jaap := &models.Person{Id: 32, Name: "Jaap Joosten", Email: "jaap@joosten", Phone: &models.PhoneNumber{Number: "053218622189", Type: models.PhoneType_HOME}}
+	anna := &models.Person{Id: 33, Name: "Anna Joosten"}
+	support := &Principal{Subject: "support", Scopes: []string{"people:read"}, Claims: map[string]interface{}{"team": "support", "ids": []interface{}{float64(33)}, "level": float64(2)}}
+
+	for _, test := range []struct {
+		rule      string
+		person    *models.Person
+		principal *Principal
+		allowed   bool
+	}{
+		{`person.id == 32`, jaap, nil, true},
+		{`person.id == 32`, anna, nil, false},
+		{`person.id != 32 && person.name startsWith "Anna"`, anna, nil, true},
+		{`person.email endsWith '@joosten'`, jaap, nil, true},
+		{`person.email endsWith "@joosten"`, anna, nil, false},
+		{`person.phone.type == "HOME"`, jaap, nil, true},
+		{`person.phone.type == "HOME"`, anna, nil, false},
+		{`person.id in principal.ids`, anna, support, true},
+		{`person.id in principal.ids`, jaap, support, false},
+		{`person.id in principal.ids`, anna, nil, false},
+		{`principal.team in ["support", "sales"] || principal.subject == "admin"`, jaap, support, true},
+		{`principal.scopes contains "people:read" && !(person.id < 33)`, anna, support, true},
+		{`principal.level >= 3 || person.name contains "Jaap"`, jaap, support, true},
+		{`principal.level >= 3`, jaap, support, false},
+		{`principal.team == null`, jaap, nil, true},
+	} {
+		policy, err := compilePolicy([]string{test.rule})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if policy.allows(test.person, test.principal) != test.allowed {
+			t.Fatalf("rule %s on %v for %v: expected %v", test.rule, test.person, test.principal, test.allowed)
+		}
+	}
+
+	for _, rule := range []string{
+		`person.unknown == 1`,
+		`person.phone == 1`,
+		`person.id ==`,
+		`person.name == "Jaap`,
+		`(person.id == 32`,
+		`person.id == 32 32`,
+		`name == "Jaap"`,
+		`person.id in [32 33]`,
+	} {
+		_, err := compilePolicy([]string{rule})
+		if err == nil {
+			t.Fatalf("invalid rule %s compiled", rule)
+		}
+	}
+}
+
+func TestPolicyStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store := newFileStore(filepath.Join(dir, "data.bin"))
+	err := store.Put(&models.Person{Id: 32, Name: "Jaap Joosten"}, &models.Person{Id: 33, Name: "Anna Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := compilePolicy([]string{`person.id in principal.ids`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := withPolicy(context.Background(), policy)
+	if restrictStore(ctx, store) != PersonStore(store) {
+		t.Fatal("store restricted without authentication")
+	}
+
+	restricted := restrictStore(withPrincipal(ctx, &Principal{Subject: "support", Claims: map[string]interface{}{"ids": []interface{}{float64(33)}}}), store)
+	person, err := restricted.Person(32)
+	if err != nil || person != nil {
+		t.Fatalf("unexpected person %v, %v", person, err)
+	}
+	person, err = restricted.Person(33)
+	if err != nil || person == nil {
+		t.Fatalf("unexpected person %v, %v", person, err)
+	}
+
+	var ids []int32
+	err = restricted.ForEach(func(person *models.Person) error {
+		ids = append(ids, person.Id)
+		return nil
+	})
+	if err != nil || len(ids) != 1 || ids[0] != 33 {
+		t.Fatalf("unexpected people %v, %v", ids, err)
+	}
+
+	err = restricted.Put(&models.Person{Id: 34, Name: "Piet Joosten"})
+	if err == nil {
+		t.Fatal("stored a person the caller can't see")
+	}
+	err = restricted.Delete(32)
+	if err == nil {
+		t.Fatal("deleted a person the caller can't see")
+	}
+
+	anonymous := restrictStore(withPrincipal(ctx, nil), store)
+	person, err = anonymous.Person(33)
+	if err != nil || person != nil {
+		t.Fatalf("unexpected person %v for anonymous caller, %v", person, err)
+	}
+}
+
+func TestPolicyQuery(t *testing.T) {
+	config := defaultConfig()
+	config.Policies.Rules = []string{`principal.team == "support" && person.email endsWith "@joosten"`}
+	err := config.validate()
+	if err == nil || !strings.Contains(err.Error(), "policy rules need API keys or a JWKS") {
+		t.Fatalf("policy rules accepted without authentication: %v", err)
+	}
+
+	config.Auth.APIKeys = []APIKey{
+		{Key: "support", Subject: "support", Claims: map[string]interface{}{"team": "support"}},
+		{Key: "sales", Subject: "sales", Claims: map[string]interface{}{"team": "sales"}},
+	}
+	err = config.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := authenticate(config.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth(queryHandler(newFileStore("data.bin"), config, nil))
+
+	for key, expected := range map[string]string{
+		"support": `{"person":{"name":"Jaap Joosten"}}`,
+		"sales":   `{"person":null}`,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person(id: 32) { name } }"}`))
+		request.Header.Set(apiKeyHeader, key)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if response.Code != http.StatusOK || response.Body.String() != expected+"\n" {
+			t.Fatalf("%s: unexpected response %d: %s", key, response.Code, response.Body)
+		}
+	}
+}
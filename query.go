@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// queryCommand executes a GraphQL document on the person store without starting
+// the server and prints the result as JSON.
+func queryCommand(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	stores := addStoreFlags(flags)
+	file := flags.String("file", "", "file holding the GraphQL document")
+	variables := flags.String("variables", "", "variables as JSON object, or @file to read them from a file")
+	operation := flags.String("operation", "", "name of the operation to execute")
+	flags.Parse(args)
+
+	request := queryRequest{OperationName: *operation}
+
+	// the document is taken from the argument, the file or stdin
+	var err error
+	switch {
+	case flags.NArg() > 0 && flags.Arg(0) != "-":
+		request.Query = strings.Join(flags.Args(), " ")
+	case *file != "":
+		request.Query, err = readArgument(*file)
+	default:
+		request.Query, err = readArgument("-")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read query: %v", err)
+	}
+
+	if *variables != "" {
+		data := *variables
+		if strings.HasPrefix(data, "@") {
+			data, err = readArgument(data[1:])
+			if err != nil {
+				return fmt.Errorf("failed to read variables: %v", err)
+			}
+		}
+		err = json.Unmarshal([]byte(data), &request.Variables)
+		if err != nil {
+			return fmt.Errorf("invalid variables: %v", err)
+		}
+	}
+
+	store, err := stores.open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	result, err := execute(context.Background(), request, store)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(result)
+}
+
+// readArgument reads the contents of a file, or stdin for "-".
+func readArgument(name string) (string, error) {
+	if name == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		return string(data), err
+	}
+	data, err := ioutil.ReadFile(name)
+	return string(data), err
+}
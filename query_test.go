@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestExecute(t *testing.T) {
+	request := queryRequest{
+		Query: `query Other { person { id } }
+			query Phone($id: Int) { person(id: $id) { name phone { number type } } }`,
+		OperationName: "Phone",
+		Variables:     map[string]interface{}{"id": float64(32)},
+	}
+
+	result, err := execute(context.Background(), request, newFileStore("data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"person": map[string]interface{}{
+		"name":  "Jaap Joosten",
+		"phone": map[string]interface{}{"number": "053218622189", "type": "HOME"},
+	}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Fatalf("response assertion failed: %v != %v", expected, result)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultTier is the tier of clients without a known tier claim.
+const defaultTier = "default"
+
+// idleClientTimeout is how long the limiters of a client are kept after its last request.
+const idleClientTimeout = 10 * time.Minute
+
+// rateLimiter limits the requests and the cost of the queries of every client,
+// keyed by the subject of the caller or else by its IP address, with token buckets
+// that are configured per tier.
+type rateLimiter struct {
+	config RateLimits
+
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+	swept   time.Time
+}
+
+// clientLimiter holds the token buckets of a client.
+type clientLimiter struct {
+	tier     string
+	requests *rate.Limiter
+	cost     *rate.Limiter
+	seen     time.Time
+}
+
+// newRateLimiter returns the rate limiter of the configured tiers, or nil when
+// no tier has a limit.
+func newRateLimiter(config RateLimits) *rateLimiter {
+	limited := config.Default != RateTier{}
+	for _, tier := range config.Tiers {
+		limited = limited || tier != RateTier{}
+	}
+	if !limited {
+		return nil
+	}
+	return &rateLimiter{config: config, clients: make(map[string]*clientLimiter)}
+}
+
+func (t RateTier) valid() bool {
+	return t.RequestsPerMinute >= 0 && t.Burst >= 0 && t.CostPerMinute >= 0 && t.CostBurst >= 0
+}
+
+// perMinute returns the token bucket that fills with the given tokens per minute,
+// which is unlimited for zero.
+func perMinute(tokens, burst int64) *rate.Limiter {
+	if tokens <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst <= 0 {
+		burst = tokens
+	}
+	return rate.NewLimiter(rate.Limit(float64(tokens)/60), int(burst))
+}
+
+// client returns the limiters of the client of a request.
+func (l *rateLimiter) client(r *http.Request) *clientLimiter {
+	principal := principalFromContext(r.Context())
+	if principal == nil {
+		return l.address(r)
+	}
+	tier := defaultTier
+	if claimed, ok := principal.Claims[l.config.Claim].(string); ok {
+		if _, ok := l.config.Tiers[claimed]; ok {
+			tier = claimed
+		}
+	}
+	return l.limiters("principal:"+principal.Subject, tier)
+}
+
+// address returns the limiters of the IP address of a request, which limit the
+// anonymous requests and the failed authentications.
+func (l *rateLimiter) address(r *http.Request) *clientLimiter {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return l.limiters("ip:"+host, defaultTier)
+}
+
+// limiters returns the limiters of a client in a tier.
+func (l *rateLimiter) limiters(key, tier string) *clientLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) > time.Minute {
+		for key, client := range l.clients {
+			if now.Sub(client.seen) > idleClientTimeout {
+				delete(l.clients, key)
+			}
+		}
+		l.swept = now
+	}
+
+	client, ok := l.clients[key]
+	if !ok || client.tier != tier {
+		config := l.config.Default
+		if tier != defaultTier {
+			config = l.config.Tiers[tier]
+		}
+		client = &clientLimiter{
+			tier:     tier,
+			requests: perMinute(config.RequestsPerMinute, config.Burst),
+			cost:     perMinute(config.CostPerMinute, config.CostBurst),
+		}
+		l.clients[key] = client
+	}
+	client.seen = now
+	return client
+}
+
+// guard rejects the requests of IP addresses over their request rate before they
+// are authenticated, and charges the failed authentications to the address, so
+// credentials can't be guessed faster than anonymous requests are allowed.
+func (l *rateLimiter) guard(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := l.address(r)
+		if client.requests.Limit() != rate.Inf && client.requests.Tokens() < 1 {
+			reservation := client.requests.Reserve()
+			delay := reservation.Delay()
+			reservation.Cancel()
+			failed := rateLimitError("RATE_LIMITED", client.tier, fmt.Sprintf("too many requests, retry in %v", delay.Round(time.Second)), delay)
+			if info := queryInfoFromContext(r.Context()); info != nil {
+				info.codes = failed.codes()
+			}
+			writeQueryError(w, failed)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withAuthFailure(r.Context(), func() { client.requests.Allow() })))
+	})
+}
+
+// middleware rejects the requests of clients over their request rate, and charges
+// the cost of their queries before they are executed.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := l.client(r)
+		reservation := client.requests.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			failed := rateLimitError("RATE_LIMITED", client.tier, fmt.Sprintf("too many requests, retry in %v", delay.Round(time.Second)), delay)
+			if info := queryInfoFromContext(r.Context()); info != nil {
+				info.codes = failed.codes()
+			}
+			writeQueryError(w, failed)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withCostQuota(r.Context(), client.chargeCost)))
+	})
+}
+
+// chargeCost takes the cost of a query from the cost quota of the client. A query
+// that costs more than the cost burst can never run, so it's invalid rather than
+// limited: it fails with 400 Bad Request and without a time to retry.
+func (c *clientLimiter) chargeCost(cost int) *queryError {
+	if c.cost.Limit() == rate.Inf {
+		return nil
+	}
+	// a query costs at least 1, and a cost that doesn't fit the bucket is refused, so
+	// ReserveN is never given a cost that would refill it
+	if cost < 1 {
+		cost = 1
+	}
+	if cost > c.cost.Burst() {
+		return rateLimitError("COST_QUOTA_EXCEEDED", c.tier, fmt.Sprintf("query cost %d exceeds the cost quota of %d", cost, c.cost.Burst()), 0)
+	}
+	reservation := c.cost.ReserveN(time.Now(), cost)
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return rateLimitError("COST_QUOTA_EXCEEDED", c.tier, fmt.Sprintf("cost quota exhausted, retry in %v", delay.Round(time.Second)), delay)
+	}
+	return nil
+}
+
+type costQuotaKey struct{}
+
+func withCostQuota(ctx context.Context, charge func(cost int) *queryError) context.Context {
+	return context.WithValue(ctx, costQuotaKey{}, charge)
+}
+
+// costQuotaFromContext returns the function that charges the cost of a query to
+// the client, if the client has a cost quota.
+func costQuotaFromContext(ctx context.Context) func(cost int) *queryError {
+	charge, _ := ctx.Value(costQuotaKey{}).(func(cost int) *queryError)
+	return charge
+}
+
+type authFailureKey struct{}
+
+func withAuthFailure(ctx context.Context, charge func()) context.Context {
+	return context.WithValue(ctx, authFailureKey{}, charge)
+}
+
+// authFailureFromContext returns the function that charges a failed authentication
+// to the IP address of the request, if the address is rate limited.
+func authFailureFromContext(ctx context.Context) func() {
+	charge, _ := ctx.Value(authFailureKey{}).(func())
+	return charge
+}
+
+func rateLimitError(code, tier, message string, retryAfter time.Duration) *queryError {
+	observeRateLimited(tier, code)
+	err := gqlerrors.NewFormattedError(message)
+	err.Extensions = map[string]interface{}{"code": code, "tier": tier}
+	if retryAfter > 0 {
+		err.Extensions["retryAfter"] = retrySeconds(retryAfter)
+	}
+	failed := newQueryError(code, fmt.Errorf("failed to execute graphql operation: %s", message), []gqlerrors.FormattedError{err})
+	failed.retryAfter = retryAfter
+	return failed
+}
+
+func retrySeconds(delay time.Duration) int {
+	return int(math.Ceil(delay.Seconds()))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	limiter := newRateLimiter(RateLimits{Default: RateTier{RequestsPerMinute: 1, Burst: 2}})
+	handler := limiter.middleware(queryHandler(newFileStore("data.bin"), defaultConfig(), nil))
+
+	query := func(addr string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person(id: 32) { name } }"}`))
+		request.RemoteAddr = addr
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	for i := 0; i < 2; i++ {
+		if response := query("192.0.2.1:1234"); response.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+		}
+	}
+	response := query("192.0.2.1:4321")
+	if response.Code != http.StatusTooManyRequests || errorCode(t, response.Body.String()) != "RATE_LIMITED" {
+		t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+	}
+	if retryAfter := response.Header().Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+		t.Fatalf("unexpected Retry-After %q", retryAfter)
+	}
+
+	if response := query("192.0.2.2:1234"); response.Code != http.StatusOK {
+		t.Fatalf("other client limited: %d: %s", response.Code, response.Body)
+	}
+
+	if newRateLimiter(RateLimits{Tiers: map[string]RateTier{"free": {}}}) != nil {
+		t.Fatal("rate limiter without limits")
+	}
+}
+
+func TestCostQuota(t *testing.T) {
+	auth, err := authenticate(Auth{APIKeys: []APIKey{
+		{Key: "free", Subject: "free"},
+		{Key: "gold", Subject: "gold", Claims: map[string]interface{}{"tier": "gold"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newRateLimiter(RateLimits{
+		Default: RateTier{CostPerMinute: 1, CostBurst: 8},
+		Tiers:   map[string]RateTier{"gold": {CostPerMinute: 600}},
+		Claim:   "tier",
+	})
+	handler := auth(limiter.middleware(queryHandler(newFileStore("data.bin"), defaultConfig(), nil)))
+
+	query := func(key, query string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "`+query+`"}`))
+		request.Header.Set(apiKeyHeader, key)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	// the query costs 4, so the free tier has a burst of two queries
+	for i := 0; i < 2; i++ {
+		if response := query("free", "{ person(id: 32) { name email } }"); response.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+		}
+	}
+	response := query("free", "{ person(id: 32) { name email } }")
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") == "" {
+		t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+	}
+	var body struct {
+		Errors []struct {
+			Extensions map[string]interface{} `json:"extensions"`
+		} `json:"errors"`
+	}
+	err = json.Unmarshal(response.Body.Bytes(), &body)
+	if err != nil || len(body.Errors) != 1 {
+		t.Fatalf("unexpected response %s", response.Body)
+	}
+	extensions := body.Errors[0].Extensions
+	if extensions["code"] != "COST_QUOTA_EXCEEDED" || extensions["tier"] != "default" || extensions["retryAfter"] == nil {
+		t.Fatalf("unexpected extensions %v", extensions)
+	}
+
+	// a query that costs more than the burst is invalid, so it can't be retried
+	response = query("free", "{ person(id: 32) { history(first: 5) { seq } } }")
+	if response.Code != http.StatusBadRequest || response.Header().Get("Retry-After") != "" {
+		t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+	}
+	body.Errors = nil
+	err = json.Unmarshal(response.Body.Bytes(), &body)
+	if err != nil || len(body.Errors) != 1 {
+		t.Fatalf("unexpected response %s", response.Body)
+	}
+	extensions = body.Errors[0].Extensions
+	if extensions["code"] != "COST_QUOTA_EXCEEDED" || extensions["retryAfter"] != nil {
+		t.Fatalf("unexpected extensions %v", extensions)
+	}
+
+	for i := 0; i < 3; i++ {
+		if response := query("gold", "{ person(id: 32) { name email } }"); response.Code != http.StatusOK {
+			t.Fatalf("gold tier limited: %d: %s", response.Code, response.Body)
+		}
+	}
+}
+
+func TestAuthFailureRateLimit(t *testing.T) {
+	auth, err := authenticate(Auth{APIKeys: []APIKey{{Key: "secret", Subject: "client"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newRateLimiter(RateLimits{Default: RateTier{RequestsPerMinute: 1, Burst: 3}})
+	handler := limiter.guard(auth(limiter.middleware(queryHandler(newFileStore("data.bin"), defaultConfig(), nil))))
+
+	query := func(addr, key string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person(id: 32) { name } }"}`))
+		request.RemoteAddr = addr
+		request.Header.Set(apiKeyHeader, key)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	for i := 0; i < 3; i++ {
+		if response := query("192.0.2.1:1234", "guess"); response.Code != http.StatusUnauthorized {
+			t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+		}
+	}
+	// the address is rejected before its keys are checked, so a valid key doesn't
+	// tell the guess apart
+	for _, key := range []string{"guess", "secret"} {
+		response := query("192.0.2.1:1234", key)
+		if response.Code != http.StatusTooManyRequests || errorCode(t, response.Body.String()) != "RATE_LIMITED" {
+			t.Fatalf("key %s: unexpected response %d: %s", key, response.Code, response.Body)
+		}
+	}
+
+	// authenticated requests are charged to the caller, not to its address
+	for i := 0; i < 3; i++ {
+		if response := query("192.0.2.2:1234", "secret"); response.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+		}
+	}
+	if response := query("192.0.2.2:1234", "guess"); response.Code != http.StatusUnauthorized {
+		t.Fatalf("authenticated requests charged to the address: %d: %s", response.Code, response.Body)
+	}
+}
+
+func TestTierClaim(t *testing.T) {
+	limiter := newRateLimiter(RateLimits{
+		Default: RateTier{RequestsPerMinute: 1},
+		Tiers:   map[string]RateTier{"gold": {RequestsPerMinute: 600}},
+		Claim:   "plan",
+	})
+
+	for expected, claims := range map[string]map[string]interface{}{
+		"gold":    {"plan": "gold"},
+		"default": {"tier": "gold"},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/query", nil)
+		request = request.WithContext(withPrincipal(request.Context(), &Principal{Subject: expected, Claims: claims}))
+		if tier := limiter.client(request).tier; tier != expected {
+			t.Fatalf("claims %v: unexpected tier %s", claims, tier)
+		}
+	}
+
+	// a cost below 1 doesn't refill the bucket
+	client := &clientLimiter{tier: defaultTier, cost: perMinute(1, 2)}
+	for _, cost := range []int{2, -1000} {
+		client.chargeCost(cost)
+	}
+	if client.chargeCost(1) == nil {
+		t.Fatal("negative cost refilled the cost quota")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/graphql-go/graphql"
+	"sort"
+)
+
+// addField adds a field to one of the generated types. The generated types define
+// their fields in a thunk, which AddFieldConfig leaves untouched, so the field is
+// added to the resolved field definitions instead.
+func addField(object *graphql.Object, name string, field *graphql.Field) {
+	names := make([]string, 0, len(field.Args))
+	for argName := range field.Args {
+		names = append(names, argName)
+	}
+	sort.Strings(names)
+
+	args := make([]*graphql.Argument, 0, len(names))
+	for _, argName := range names {
+		arg := field.Args[argName]
+		args = append(args, &graphql.Argument{
+			PrivateName:        argName,
+			Type:               arg.Type,
+			DefaultValue:       arg.DefaultValue,
+			PrivateDescription: arg.Description,
+		})
+	}
+
+	object.Fields()[name] = &graphql.FieldDefinition{
+		Name:        name,
+		Description: field.Description,
+		Type:        field.Type,
+		Args:        args,
+		Resolve:     field.Resolve,
+	}
+}
+
+// wrapResolvers replaces the resolvers of the fields of an object with the result
+// of wrap, which is given the field name and the resolver it wraps.
+func wrapResolvers(object *graphql.Object, wrap func(name string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn) {
+	for name, field := range object.Fields() {
+		resolve := field.Resolve
+		if resolve == nil {
+			resolve = graphql.DefaultResolveFn
+		}
+		field.Resolve = wrap(name, resolve)
+	}
+}
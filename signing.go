@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// signatureMagic starts signed data files.
+const signatureMagic = "GQPBSIG1"
+
+// maxMetadataSize protects the readers against corrupt signature headers.
+const maxMetadataSize = 64 << 10
+
+// signedData are the public keys that verify signed data files, and whether data
+// files that aren't signed are refused.
+var signedData struct {
+	keys   map[string]ed25519.PublicKey
+	strict bool
+}
+
+var errUnsigned = errors.New("data file is not signed")
+
+var errNoSigningKeys = errors.New("data file is signed, but no signing keys are configured to verify it")
+
+var errStrictWrite = errors.New("data files can't be written in strict signing mode, as they aren't signed")
+
+// signatureMetadata describes a signed data file. It is covered by the signature.
+type signatureMetadata struct {
+	Producer  string    `json:"producer"`
+	Timestamp time.Time `json:"timestamp"`
+	// Key is the fingerprint of the public key that verifies the signature.
+	Key string `json:"key"`
+}
+
+// useSigning verifies signed data files with the public keys in the given PEM
+// files, and refuses data files that aren't signed in strict mode.
+func useSigning(config Signing) error {
+	signedData.keys, signedData.strict = nil, config.Strict
+	if config.Keys == "" {
+		return nil
+	}
+
+	signedData.keys = make(map[string]ed25519.PublicKey)
+	for _, path := range strings.Split(config.Keys, ",") {
+		key, err := readPublicKey(strings.TrimSpace(path))
+		if err != nil {
+			return err
+		}
+		signedData.keys[keyFingerprint(key)] = key
+	}
+	return nil
+}
+
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %v", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key %s: %v", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to read public key %s: not an Ed25519 key", path)
+	}
+	return public, nil
+}
+
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key %s: %v", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to read private key %s: not an Ed25519 key", path)
+	}
+	return private, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return block, nil
+}
+
+// keyFingerprint identifies a public key in the metadata of signed data files.
+func keyFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signedDigest hashes the parts of a signed data file that are signed: the magic,
+// the metadata and the payload.
+func signedDigest(metadata []byte) hash.Hash {
+	digest := sha512.New()
+	digest.Write([]byte(signatureMagic))
+	digest.Write(binary.AppendUvarint(nil, uint64(len(metadata))))
+	digest.Write(metadata)
+	return digest
+}
+
+// verifyData checks the signature of a data file before any of it is decoded and
+// returns the people in it, from the data that was verified. Files that aren't
+// signed are returned as they are, unless strict mode is on; signed files are
+// refused when there are no keys to verify them.
+func verifyData(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(signatureMagic)) {
+		if signedData.strict {
+			return nil, errUnsigned
+		}
+		return data, nil
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data[len(signatureMagic):]))
+	metadata, signature, err := readSignatureHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	var meta signatureMetadata
+	err = json.Unmarshal(metadata, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature metadata: %v", err)
+	}
+
+	if signedData.keys == nil {
+		return nil, errNoSigningKeys
+	}
+	key, ok := signedData.keys[meta.Key]
+	if !ok {
+		return nil, fmt.Errorf("data file of %s is signed with untrusted key %s", meta.Producer, meta.Key)
+	}
+	payload := data[len(signatureMagic)+fieldSize(metadata)+fieldSize(signature):]
+	digest := signedDigest(metadata)
+	digest.Write(payload)
+	err = ed25519.VerifyWithOptions(key, digest.Sum(nil), signature, &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		return nil, fmt.Errorf("signature of the data file of %s doesn't verify, the data was changed", meta.Producer)
+	}
+	return payload, nil
+}
+
+// readSignatureHeader reads the metadata and the signature of a signed data file,
+// after the magic.
+func readSignatureHeader(r *bufio.Reader) (metadata, signature []byte, err error) {
+	metadata, err = readField(r, maxMetadataSize)
+	if err == nil {
+		signature, err = readField(r, ed25519.SignatureSize)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid signature header: %v", err)
+	}
+	return metadata, signature, nil
+}
+
+// signCommand signs a data file, so it can be verified by the servers that trust
+// the public key.
+func signCommand(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := flags.String("key", "", "PEM file with the Ed25519 private key")
+	producer := flags.String("producer", "", "producer of the data, recorded in the signature")
+	out := flags.String("out", "", "signed data file, by default the data file is signed in place")
+	flags.Parse(args)
+
+	if *keyPath == "" || *producer == "" || flags.NArg() != 1 {
+		return fmt.Errorf("usage: sign -key private.pem -producer name [-out signed.bin] data.bin")
+	}
+	if *out == "" {
+		*out = flags.Arg(0)
+	}
+	key, err := readPrivateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	payload, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read data: %v", err)
+	}
+	// a signed file is signed again
+	if bytes.HasPrefix(payload, []byte(signatureMagic)) {
+		reader := bufio.NewReader(bytes.NewReader(payload[len(signatureMagic):]))
+		_, _, err = readSignatureHeader(reader)
+		if err != nil {
+			return err
+		}
+		payload, _ = ioutil.ReadAll(reader)
+	}
+
+	signed, err := signData(key, signatureMetadata{Producer: *producer, Timestamp: time.Now().UTC()}, payload)
+	if err != nil {
+		return err
+	}
+	err = writeSigned(*out, signed)
+	if err != nil {
+		return fmt.Errorf("failed to write signed data: %v", err)
+	}
+	fmt.Printf("signed %s with key %s\n", *out, keyFingerprint(key.Public().(ed25519.PublicKey)))
+	return nil
+}
+
+// signData returns the signed data file of a payload.
+func signData(key ed25519.PrivateKey, meta signatureMetadata, payload []byte) ([]byte, error) {
+	meta.Key = keyFingerprint(key.Public().(ed25519.PublicKey))
+	metadata, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	digest := signedDigest(metadata)
+	digest.Write(payload)
+	signature, err := key.Sign(nil, digest.Sum(nil), &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign data: %v", err)
+	}
+
+	signed := []byte(signatureMagic)
+	signed = binary.AppendUvarint(signed, uint64(len(metadata)))
+	signed = append(signed, metadata...)
+	signed = binary.AppendUvarint(signed, uint64(len(signature)))
+	signed = append(signed, signature...)
+	return append(signed, payload...), nil
+}
+
+// writeSigned replaces a file with signed data, next to the original and renamed
+// into place.
+func writeSigned(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := writeFile(tmp, data)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSigningKey writes a new Ed25519 key pair as PEM files and returns their paths.
+func writeSigningKey(t *testing.T, dir, name string) (string, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privatePath, publicPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".pub.pem")
+	err = ioutil.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return privatePath, publicPath
+}
+
+func TestSignedData(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer useSigning(Signing{})
+
+	private, public := writeSigningKey(t, dir, "upstream")
+	other, _ := writeSigningKey(t, dir, "other")
+
+	data, err := ioutil.ReadFile("data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, signed, untrusted := filepath.Join(dir, "unsigned.bin"), filepath.Join(dir, "signed.bin"), filepath.Join(dir, "untrusted.bin")
+	err = ioutil.WriteFile(unsigned, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = signCommand([]string{"-key", private, "-producer", "upstream", "-out", signed, unsigned})
+	if err == nil {
+		err = signCommand([]string{"-key", other, "-producer", "other", "-out", untrusted, unsigned})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unsigned files are read without strict mode, signed files aren't read without keys
+	person, err := newFileStore(unsigned).Person(32)
+	if err != nil || person == nil || person.Name != "Jaap Joosten" {
+		t.Fatalf("unexpected person %v, %v", person, err)
+	}
+	_, err = newFileStore(signed).Person(32)
+	if err == nil || !strings.Contains(err.Error(), errNoSigningKeys.Error()) {
+		t.Fatalf("signed file read without keys: %v", err)
+	}
+
+	// inspect and diff verify signed files
+	err = inspectCommand([]string{"-signing-keys", public, signed})
+	if err == nil {
+		err = diffCommand([]string{"-signing-keys", public, unsigned, signed})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = diffCommand([]string{unsigned, signed})
+	if err == nil {
+		t.Fatal("diff read a signed file without keys")
+	}
+
+	err = useSigning(Signing{Keys: public, Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	person, err = newFileStore(signed).Person(32)
+	if err != nil || person == nil || person.Name != "Jaap Joosten" {
+		t.Fatalf("unexpected person %v, %v", person, err)
+	}
+
+	// writes aren't signed, so they are refused in strict mode
+	err = newFileStore(signed).Put(&models.Person{Id: 33, Name: "Anna Joosten"})
+	if err == nil || !strings.Contains(err.Error(), errStrictWrite.Error()) {
+		t.Fatalf("data file written in strict mode: %v", err)
+	}
+
+	// signing a signed file again replaces the signature
+	err = signCommand([]string{"-key", private, "-producer", "upstream", signed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	person, err = newFileStore(signed).Person(32)
+	if err != nil || person == nil {
+		t.Fatalf("unexpected person %v, %v", person, err)
+	}
+
+	tampered := filepath.Join(dir, "tampered.bin")
+	content, err := ioutil.ReadFile(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = []byte(strings.Replace(string(content), "Jaap", "Piet", 1))
+	err = ioutil.WriteFile(tampered, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{
+		unsigned:  "not signed",
+		tampered:  "doesn't verify",
+		untrusted: "untrusted key",
+	} {
+		_, err = newFileStore(path).Person(32)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%s: unexpected error %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/golang/protobuf/proto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PersonStore holds the people that are exposed through the GraphQL schema.
+type PersonStore interface {
+	// Person returns the person with the given id, or nil when it is not stored.
+	Person(id int32) (*models.Person, error)
+	// ForEach calls fn for every stored person until fn returns an error.
+	ForEach(fn func(person *models.Person) error) error
+	// Put stores the given people in a single transaction.
+	Put(people ...*models.Person) error
+	// Delete removes the person with the given id.
+	Delete(id int32) error
+	// History returns the stored versions of the person with the given id, newest first.
+	History(id int32) ([]Version, error)
+	Close() error
+}
+
+// maxRecordSize protects the readers against corrupt length prefixes.
+const maxRecordSize = 64 << 20
+
+var errStop = errors.New("stop iteration")
+
+type storeKey struct{}
+
+// withStore makes the store available to the resolvers of a query.
+func withStore(ctx context.Context, store PersonStore) context.Context {
+	return context.WithValue(ctx, storeKey{}, store)
+}
+
+// storeFromContext returns the store of a query, which traces its calls when the
+// query is traced, audits its changes when the query is audited and only holds the
+// people the caller can see.
+func storeFromContext(ctx context.Context) PersonStore {
+	return restrictStore(ctx, recordChanges(ctx, traceStore(ctx, ctx.Value(storeKey{}).(PersonStore))))
+}
+
+// dataFlags are the flags with the keys that read and write person data.
+type dataFlags struct {
+	keyfile *string
+	signing *string
+}
+
+// addDataFlags adds the flags with the keys of the person data to a command.
+func addDataFlags(flags *flag.FlagSet) *dataFlags {
+	return &dataFlags{
+		keyfile: flags.String("keyfile", "", "keyfile with the keys that encrypt the person data"),
+		signing: flags.String("signing-keys", "", "PEM files with the public keys that verify signed data files, comma separated"),
+	}
+}
+
+// use configures the keys of the person data.
+func (f *dataFlags) use() error {
+	err := useKeyfile(*f.keyfile)
+	if err == nil {
+		err = useSigning(Signing{Keys: *f.signing})
+	}
+	return err
+}
+
+// storeFlags are the flags that select the person store of a command.
+type storeFlags struct {
+	*dataFlags
+	backend *string
+	path    *string
+	tenant  *string
+}
+
+// addStoreFlags adds the flags that select the person store to a command.
+func addStoreFlags(flags *flag.FlagSet) *storeFlags {
+	return &storeFlags{
+		dataFlags: addDataFlags(flags),
+		backend:   flags.String("store", "file", "person store backend: file, bolt or wal"),
+		path:      flags.String("data", "data.bin", "path of the person data, with {tenant} for the stores of tenants"),
+		tenant:    flags.String("tenant", "", "tenant whose store is opened"),
+	}
+}
+
+// open opens the selected store.
+func (f *storeFlags) open() (PersonStore, error) {
+	path, err := tenantPath(*f.path, *f.tenant)
+	if err == nil {
+		err = f.use()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return openStore(*f.backend, path)
+}
+
+func openStore(backend, path string) (PersonStore, error) {
+	switch backend {
+	case "file":
+		return newFileStore(path), nil
+	case "bolt":
+		return openBoltStore(path)
+	case "wal":
+		return openWALStore(path)
+	}
+	return nil, fmt.Errorf("unknown store backend %q", backend)
+}
+
+// firstPerson returns the person that is served when a query does not ask for an id.
+func firstPerson(store PersonStore) (*models.Person, error) {
+	var first *models.Person
+	err := store.ForEach(func(person *models.Person) error {
+		first = person
+		return errStop
+	})
+	if err != nil && err != errStop {
+		return nil, err
+	}
+	return first, nil
+}
+
+// fileStore keeps all people in a single data file, which is rewritten on every change.
+type fileStore struct {
+	path string
+	mu   *sync.Mutex
+	// ctx is the context of the request the data file is read for.
+	ctx context.Context
+}
+
+func newFileStore(path string) *fileStore {
+	return &fileStore{path: path, mu: &sync.Mutex{}, ctx: context.Background()}
+}
+
+func (s *fileStore) withContext(ctx context.Context) PersonStore {
+	store := *s
+	store.ctx = ctx
+	return &store
+}
+
+func (s *fileStore) Person(id int32) (*models.Person, error) {
+	var found *models.Person
+	err := s.ForEach(func(person *models.Person) error {
+		if person.Id == id {
+			found = person
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		return nil, err
+	}
+	return found, nil
+}
+
+func (s *fileStore) ForEach(fn func(person *models.Person) error) error {
+	return getData(s.ctx, s.path, fn)
+}
+
+func (s *fileStore) Put(people ...*models.Person) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.load(false)
+	if err != nil {
+		return err
+	}
+
+	for _, person := range people {
+		replaced := false
+		for i, existing := range stored {
+			if existing.Id == person.Id {
+				stored[i] = person
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			stored = append(stored, person)
+		}
+	}
+
+	return writeData(s.path, stored)
+}
+
+func (s *fileStore) Delete(id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.load(false)
+	if err != nil {
+		return err
+	}
+
+	kept := stored[:0]
+	for _, person := range stored {
+		if person.Id != id {
+			kept = append(kept, person)
+		}
+	}
+
+	return writeData(s.path, kept)
+}
+
+// History returns the current person as the only version, as the data file
+// doesn't keep earlier versions. The version is dated by the file modification time.
+func (s *fileStore) History(id int32) ([]Version, error) {
+	person, err := s.Person(id)
+	if err != nil || person == nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data: %v", err)
+	}
+	return []Version{{Time: info.ModTime(), Person: person}}, nil
+}
+
+// Rekey writes the data file again, encrypted with the current key.
+func (s *fileStore) Rekey() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.load(true)
+	if err != nil {
+		return 0, err
+	}
+	return len(stored), writeData(s.path, stored)
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// load reads all people in the data file. plain allows a data file that isn't
+// encrypted while a keyfile is configured, to encrypt it.
+func (s *fileStore) load(plain bool) ([]*models.Person, error) {
+	var people []*models.Person
+	err := readData(s.ctx, s.path, plain, func(person *models.Person) error {
+		people = append(people, person)
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return people, err
+}
+
+// getData streams the people in a data file. A data file is a sequence of
+// length-delimited Person messages, which are encrypted when the file starts with
+// an encryption header; a file holding a single bare Person, as written by earlier
+// versions, is read as well. Signed data files are verified before they are read.
+// Data files that aren't encrypted are refused while a keyfile is configured.
+func getData(ctx context.Context, path string, fn func(person *models.Person) error) error {
+	return readData(ctx, path, false, fn)
+}
+
+// readData streams the people in a data file like getData. plain allows a data
+// file that isn't encrypted while a keyfile is configured.
+func readData(ctx context.Context, path string, plain bool, fn func(person *models.Person) error) (err error) {
+	start, size := time.Now(), int64(-1)
+	_, span := tracer.Start(ctx, "getData", trace.WithAttributes(attribute.String("data.path", path)))
+	defer func() {
+		observeDataLoad(size, start, err)
+		span.SetAttributes(attribute.Int64("data.size", size))
+		endSpan(span, err)
+	}()
+
+	// the people are decoded from the data that was verified, which can't change after
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read data: %w", err)
+	}
+	size = int64(len(data))
+
+	payload, err := verifyData(data)
+	if err != nil {
+		return fmt.Errorf("failed to read data: %v", err)
+	}
+	reader := newPersonReader(bytes.NewReader(payload))
+	if !plain && dataKeys != nil && reader.envelope == nil && reader.err == nil {
+		return fmt.Errorf("failed to read data: %v", errPlainData)
+	}
+	for read := 0; ; read++ {
+		person, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && read == 0 && reader.envelope == nil && reader.err == nil {
+			return getLegacyData(payload, fn)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read data: %v", err)
+		}
+
+		err = fn(person)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// getLegacyData reads the single bare Person in the verified data of a data file.
+func getLegacyData(data []byte, fn func(person *models.Person) error) error {
+	person := &models.Person{}
+	err := proto.Unmarshal(data, person)
+	if err != nil {
+		return fmt.Errorf("failed to read data: %v", err)
+	}
+
+	return fn(person)
+}
+
+// writeData replaces the data file with the given people. The file is written
+// next to the original and renamed into place, so readers never see a partial file.
+func writeData(path string, people []*models.Person) error {
+	if signedData.strict {
+		return fmt.Errorf("failed to write data: %v", errStrictWrite)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write data: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := newPersonWriter(tmp)
+	if dataKeys != nil {
+		err = writer.encrypt(dataKeys)
+	}
+	for i := 0; err == nil && i < len(people); i++ {
+		err = writer.Encode(people[i])
+	}
+	if err == nil {
+		err = writer.finish()
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write data: %v", err)
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write data: %v", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write data: %v", err)
+	}
+	return nil
+}
+
+// syncDir makes a rename in the directory durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// personReader decodes a stream of length-delimited Person messages, which are
+// decrypted when the stream starts with an encryption header. An encrypted stream
+// ends with an empty record and the sealed number of records.
+type personReader struct {
+	r        *bufio.Reader
+	count    int
+	offset   int64
+	envelope *envelope
+	// err is the error reading the encryption header.
+	err error
+}
+
+func newPersonReader(r io.Reader) *personReader {
+	reader := &personReader{r: bufio.NewReader(r)}
+	if magic, _ := reader.r.Peek(len(encryptionMagic)); string(magic) == encryptionMagic {
+		reader.r.Discard(len(encryptionMagic))
+		reader.envelope, reader.err = dataKeys.openEnvelope(reader.r)
+		if reader.envelope != nil {
+			reader.offset = int64(reader.envelope.size)
+		}
+	}
+	return reader
+}
+
+// Next returns the next person in the stream, or io.EOF at the end of the stream.
+func (r *personReader) Next() (*models.Person, error) {
+	data, err := r.NextRecord()
+	if err != nil {
+		return nil, err
+	}
+
+	person := &models.Person{}
+	err = proto.Unmarshal(data, person)
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %v", r.count-1, err)
+	}
+	return person, nil
+}
+
+// NextRecord returns the encoded message of the next record in the stream, or
+// io.EOF at the end of the stream.
+func (r *personReader) NextRecord() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	size, err := binary.ReadUvarint(r.r)
+	if err == io.EOF && r.envelope != nil {
+		return nil, fmt.Errorf("data truncated after record %d", r.count)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 && r.envelope != nil {
+		r.err = r.readEnd()
+		if r.err == nil {
+			r.err = io.EOF
+		}
+		return nil, r.err
+	}
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("record %d too large: %d bytes", r.count, size)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(r.r, data)
+	if err != nil {
+		return nil, fmt.Errorf("record %d truncated: %v", r.count, io.ErrUnexpectedEOF)
+	}
+
+	if r.envelope != nil {
+		data, err = open(r.envelope.aead, data, recordData(r.count))
+		if err != nil {
+			return nil, fmt.Errorf("record %d: failed to decrypt: %v", r.count, err)
+		}
+	}
+
+	r.count++
+	r.offset += int64(len(binary.AppendUvarint(nil, size))) + int64(size)
+	return data, nil
+}
+
+// readEnd reads the end of an encrypted stream, which is sealed with the number of
+// records in it, and checks that nothing follows.
+func (r *personReader) readEnd() error {
+	sealed, err := readField(r.r, 128)
+	if err != nil {
+		return fmt.Errorf("invalid end of data: %v", err)
+	}
+	_, err = open(r.envelope.aead, sealed, endData(r.count))
+	if err != nil {
+		return fmt.Errorf("invalid end of data after record %d: %v", r.count, err)
+	}
+	if _, err := r.r.Peek(1); err != io.EOF {
+		return fmt.Errorf("data after the end of the records")
+	}
+	r.offset += 1 + int64(fieldSize(sealed))
+	return nil
+}
+
+// Count returns the number of records read so far.
+func (r *personReader) Count() int {
+	return r.count
+}
+
+// Offset returns the position in the stream after the last record read.
+func (r *personReader) Offset() int64 {
+	return r.offset
+}
+
+// personWriter encodes people as a stream of length-delimited Person messages.
+type personWriter struct {
+	w        *bufio.Writer
+	buf      [binary.MaxVarintLen64]byte
+	count    int
+	envelope *envelope
+}
+
+func newPersonWriter(w io.Writer) *personWriter {
+	return &personWriter{w: bufio.NewWriter(w)}
+}
+
+// encrypt writes the encryption header, after which the people are encrypted
+// with a fresh data key.
+func (w *personWriter) encrypt(keys *keyring) error {
+	envelope, header, err := keys.newEnvelope()
+	if err != nil {
+		return err
+	}
+	w.envelope = envelope
+	_, err = w.w.Write(header)
+	return err
+}
+
+func (w *personWriter) Encode(person *models.Person) error {
+	data, err := proto.Marshal(person)
+	if err != nil {
+		return err
+	}
+	if w.envelope != nil {
+		data, err = seal(w.envelope.aead, data, recordData(w.count))
+		if err != nil {
+			return err
+		}
+	}
+	w.count++
+
+	n := binary.PutUvarint(w.buf[:], uint64(len(data)))
+	_, err = w.w.Write(w.buf[:n])
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(data)
+	return err
+}
+
+// finish ends an encrypted stream with the number of records in it, so a stream
+// that is cut off is detected.
+func (w *personWriter) finish() error {
+	if w.envelope == nil {
+		return nil
+	}
+	sealed, err := seal(w.envelope.aead, nil, endData(w.count))
+	if err != nil {
+		return err
+	}
+	end := binary.AppendUvarint([]byte{0}, uint64(len(sealed)))
+	_, err = w.w.Write(append(end, sealed...))
+	return err
+}
+
+func (w *personWriter) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	testPersonStore(t, newFileStore(filepath.Join(dir, "data.bin")))
+}
+
+func TestBoltStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := openBoltStore(filepath.Join(dir, "people.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testPersonStore(t, store)
+}
+
+func TestLegacyData(t *testing.T) {
+	person, err := newFileStore("data.bin").Person(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if person == nil || person.Name != "Jaap Joosten" {
+		t.Fatalf("unexpected person in data.bin: %v", person)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	to := filepath.Join(dir, "people.db")
+	err := migrateCommand([]string{"-from", "data.bin", "-to", to})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openBoltStore(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	result, err := Query("(id: 32) { name phone { number } }", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"person": map[string]interface{}{
+		"name":  "Jaap Joosten",
+		"phone": map[string]interface{}{"number": "+3153218622189"},
+	}}
+	if !reflect.DeepEqual(expected, result) {
+		t.Fatalf("response assertion failed: %v != %v", expected, result)
+	}
+}
+
+func testPersonStore(t *testing.T, store PersonStore) {
+	people := []*models.Person{
+		{Id: 1, Name: "Jaap Joosten", Email: "jaap@joosten"},
+		{Id: 2, Name: "Anna Joosten", Phone: &models.PhoneNumber{Number: "0612345678", Type: models.PhoneType_MOBILE}},
+	}
+	err := store.Put(people...)
+	if err != nil {
+		t.Fatalf("failed to put people: %v", err)
+	}
+
+	err = store.Put(&models.Person{Id: 1, Name: "Jaap Joosten", Email: "jaap@example.com"})
+	if err != nil {
+		t.Fatalf("failed to update person: %v", err)
+	}
+
+	person, err := store.Person(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if person == nil || person.Email != "jaap@example.com" {
+		t.Fatalf("person 1 not updated: %v", person)
+	}
+
+	err = store.Delete(1)
+	if err != nil {
+		t.Fatalf("failed to delete person: %v", err)
+	}
+
+	var ids []int32
+	err = store.ForEach(func(person *models.Person) error {
+		ids = append(ids, person.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("unexpected people after delete: %v", ids)
+	}
+
+	person, err = store.Person(1)
+	if err != nil || person != nil {
+		t.Fatalf("deleted person still stored: %v %v", person, err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tenantPlaceholder is replaced by the tenant in the data path of the stores of tenants.
+const tenantPlaceholder = "{tenant}"
+
+// tenantName keeps tenants from reaching outside their data path.
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// tenantPath returns the data path of the store of a tenant.
+func tenantPath(path, tenant string) (string, error) {
+	if !strings.Contains(path, tenantPlaceholder) {
+		if tenant != "" {
+			return "", fmt.Errorf("data path %s has no %s for tenant %s", path, tenantPlaceholder, tenant)
+		}
+		return path, nil
+	}
+	if tenant == "" {
+		return "", fmt.Errorf("data path %s needs a tenant", path)
+	}
+	if !tenantName.MatchString(tenant) {
+		return "", fmt.Errorf("invalid tenant %q", tenant)
+	}
+	return strings.Replace(path, tenantPlaceholder, tenant, -1), nil
+}
+
+// tenants keeps the people of every tenant in a store of its own, so a request
+// can only reach the people of its tenant.
+type tenants struct {
+	header string
+	// claim is the claim that names the tenant of callers, which every caller needs
+	// when the server authenticates requests.
+	claim  string
+	stores map[string]PersonStore
+}
+
+// tenant is the tenant of a request and its store.
+type tenant struct {
+	name  string
+	store PersonStore
+}
+
+type tenantKey struct{}
+
+func tenantFromContext(ctx context.Context) *tenant {
+	tenant, _ := ctx.Value(tenantKey{}).(*tenant)
+	return tenant
+}
+
+// openTenants opens the stores of the configured tenants, or returns nil when the
+// server has a single store.
+func openTenants(config Config) (*tenants, error) {
+	if config.Tenancy.Tenants == "" {
+		return nil, nil
+	}
+
+	t := &tenants{header: config.Tenancy.Header, stores: make(map[string]PersonStore)}
+	// without authentication there are no claims, and the header names the tenant
+	if authConfigured(config.Auth) {
+		t.claim = config.Tenancy.Claim
+	}
+	for _, name := range strings.Split(config.Tenancy.Tenants, ",") {
+		name = strings.TrimSpace(name)
+		path, err := tenantPath(config.Data, name)
+		if err == nil {
+			t.stores[name], err = openStore(config.Store, path)
+		}
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to open the store of tenant %s: %v", name, err)
+		}
+	}
+	return t, nil
+}
+
+// names returns the tenants in order.
+func (t *tenants) names() []string {
+	names := make([]string, 0, len(t.stores))
+	for name := range t.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *tenants) Close() error {
+	var err error
+	for _, store := range t.stores {
+		if closeErr := store.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// middleware resolves the tenant of a request and passes its store to next. With
+// a tenant claim, the tenant is the claim of the caller, and callers without one
+// are refused; otherwise it's named by the header.
+func (t *tenants) middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := ""
+		if t.header != "" {
+			name = r.Header.Get(t.header)
+		}
+		if t.claim != "" {
+			var claimed string
+			if principal := principalFromContext(r.Context()); principal != nil {
+				claimed, _ = principal.Claims[t.claim].(string)
+			}
+			if claimed == "" {
+				rejectRequest(w, r, http.StatusForbidden, "TENANT_FORBIDDEN", "the caller has no tenant")
+				return
+			}
+			if name != "" && name != claimed {
+				rejectRequest(w, r, http.StatusForbidden, "TENANT_FORBIDDEN", fmt.Sprintf("not allowed to access tenant %s", name))
+				return
+			}
+			name = claimed
+		}
+
+		if name == "" {
+			rejectRequest(w, r, http.StatusBadRequest, "TENANT_REQUIRED", "the request has no tenant")
+			return
+		}
+		store, ok := t.stores[name]
+		if !ok {
+			rejectRequest(w, r, http.StatusBadRequest, "UNKNOWN_TENANT", fmt.Sprintf("unknown tenant %q", name))
+			return
+		}
+
+		if info := queryInfoFromContext(r.Context()); info != nil {
+			info.tenant = name
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, &tenant{name: name, store: store})))
+	})
+}
+
+// rejectRequest responds to a request that isn't executed with a single error.
+func rejectRequest(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if info := queryInfoFromContext(r.Context()); info != nil {
+		info.codes = []string{code}
+	}
+	failed := newQueryError(code, errors.New(message), nil)
+	writeErrors(w, status, failed.errors)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTenantPath(t *testing.T) {
+	path, err := tenantPath("data/{tenant}.bin", "acme")
+	if err != nil || path != "data/acme.bin" {
+		t.Fatalf("unexpected path %s, %v", path, err)
+	}
+	path, err = tenantPath("data.bin", "")
+	if err != nil || path != "data.bin" {
+		t.Fatalf("unexpected path %s, %v", path, err)
+	}
+
+	for _, test := range []struct{ path, tenant string }{
+		{"data/{tenant}.bin", ""},
+		{"data/{tenant}.bin", "../people"},
+		{"data/{tenant}.bin", "acme/../globex"},
+		{"data/{tenant}.bin", ".hidden"},
+		{"data.bin", "acme"},
+	} {
+		_, err = tenantPath(test.path, test.tenant)
+		if err == nil {
+			t.Fatalf("tenant %q accepted for %s", test.tenant, test.path)
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := defaultConfig()
+	config.Data = filepath.Join(dir, "{tenant}.bin")
+	config.Tenancy.Tenants = "acme,globex"
+	config.Auth.APIKeys = []APIKey{
+		{Key: "acme", Subject: "acme", Claims: map[string]interface{}{"tenant": "acme"}},
+		{Key: "globex", Subject: "globex", Claims: map[string]interface{}{"tenant": "globex"}},
+		{Key: "operator", Subject: "operator"},
+	}
+	tenants, err := openTenants(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenants.Close()
+
+	// both tenants have a person 32
+	err = tenants.stores["acme"].Put(&models.Person{Id: 32, Name: "Jaap Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tenants.stores["globex"].Put(&models.Person{Id: 32, Name: "Anna Joosten"}, &models.Person{Id: 40, Name: "Piet Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := authenticate(config.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth(tenants.middleware(queryHandler(nil, config, nil)))
+
+	for _, test := range []struct {
+		key, tenant, query string
+		status             int
+		expected           string
+	}{
+		{"acme", "", "{ person(id: 32) { name } }", http.StatusOK, `{"person":{"name":"Jaap Joosten"}}`},
+		{"acme", "acme", "{ person(id: 32) { name } }", http.StatusOK, `{"person":{"name":"Jaap Joosten"}}`},
+		{"acme", "", "{ person(id: 40) { name } }", http.StatusOK, `{"person":null}`},
+		{"acme", "globex", "{ person(id: 32) { name } }", http.StatusForbidden, "TENANT_FORBIDDEN"},
+		{"globex", "", "{ person(id: 32) { name } }", http.StatusOK, `{"person":{"name":"Anna Joosten"}}`},
+		{"globex", "globex", "{ person(id: 40) { name } }", http.StatusOK, `{"person":{"name":"Piet Joosten"}}`},
+		// callers without the claim can't choose a tenant with the header
+		{"operator", "globex", "{ person(id: 32) { name } }", http.StatusForbidden, "TENANT_FORBIDDEN"},
+		{"operator", "", "{ person(id: 32) { name } }", http.StatusForbidden, "TENANT_FORBIDDEN"},
+		{"", "globex", "{ person(id: 32) { name } }", http.StatusForbidden, "TENANT_FORBIDDEN"},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "`+test.query+`"}`))
+		if test.key != "" {
+			request.Header.Set(apiKeyHeader, test.key)
+		}
+		if test.tenant != "" {
+			request.Header.Set("X-Tenant-Id", test.tenant)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		if response.Code != test.status {
+			t.Fatalf("%s for %q: unexpected response %d: %s", test.key, test.tenant, response.Code, response.Body)
+		}
+		if response.Code == http.StatusOK && response.Body.String() != test.expected+"\n" {
+			t.Fatalf("%s for %q: unexpected response %s", test.key, test.tenant, response.Body)
+		}
+		if response.Code != http.StatusOK && errorCode(t, response.Body.String()) != test.expected {
+			t.Fatalf("%s for %q: unexpected response %s", test.key, test.tenant, response.Body)
+		}
+	}
+
+	ready := &readiness{tenants: tenants}
+	if reasons := ready.check(); len(reasons) > 0 {
+		t.Fatalf("not ready: %v", reasons)
+	}
+
+	// without authentication, the header names the tenant
+	config.Auth = Auth{}
+	headerTenants, err := openTenants(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer headerTenants.Close()
+	handler = headerTenants.middleware(queryHandler(nil, config, nil))
+	for tenant, expected := range map[string]int{"globex": http.StatusOK, "": http.StatusBadRequest, "initech": http.StatusBadRequest, "../acme": http.StatusBadRequest} {
+		request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person(id: 40) { name } }"}`))
+		request.Header.Set("X-Tenant-Id", tenant)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if response.Code != expected {
+			t.Fatalf("%q: unexpected response %d: %s", tenant, response.Code, response.Body)
+		}
+	}
+}
+
+func TestTenantExport(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	err := newFileStore(filepath.Join(dir, "acme.bin")).Put(&models.Person{Id: 32, Name: "Jaap Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newFileStore(filepath.Join(dir, "globex.bin")).Put(&models.Person{Id: 40, Name: "Piet Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(dir, "{tenant}.bin")
+	out := filepath.Join(dir, "acme.ndjson")
+	err = exportCommand([]string{"-data", data, "-tenant", "acme", out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(exported), "Jaap Joosten") || strings.Contains(string(exported), "Piet Joosten") {
+		t.Fatalf("unexpected export %s", exported)
+	}
+
+	err = exportCommand([]string{"-data", data, out})
+	if err == nil {
+		t.Fatal("exported without a tenant")
+	}
+	err = exportCommand([]string{"-data", data, "-tenant", "../globex", out})
+	if err == nil {
+		t.Fatal("exported an invalid tenant")
+	}
+}
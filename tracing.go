@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/graphql-go/graphql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "graphql-meets-protobuf-sample"
+
+var tracer = otel.Tracer("github.com/FactomProject/graphql-meets-protobuf-sample")
+
+// setupTracing installs the tracer provider that exports spans as configured and
+// the W3C trace context propagator. The returned function flushes the spans.
+func setupTracing(ctx context.Context, config Tracing) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	default:
+		err = fmt.Errorf("unknown exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up tracing: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// endSpan ends a span, recording the error when there is one.
+func endSpan(span trace.Span, err error) {
+	recordError(span, err)
+	span.End()
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil && err != errStop {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+type resolverSpansKey struct{}
+
+// withResolverSpans adds a span for every resolved field to the trace of a query.
+func withResolverSpans(ctx context.Context) context.Context {
+	return context.WithValue(ctx, resolverSpansKey{}, true)
+}
+
+// traceResolvers creates spans for the resolvers of an object's fields, in the
+// queries that ask for them.
+func traceResolvers(object *graphql.Object) {
+	wrapResolvers(object, func(name string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+		spanName := "resolve " + object.Name() + "." + name
+		return func(p graphql.ResolveParams) (interface{}, error) {
+			if on, _ := p.Context.Value(resolverSpansKey{}).(bool); !on {
+				return resolve(p)
+			}
+
+			ctx, span := tracer.Start(p.Context, spanName)
+			p.Context = ctx
+			result, err := resolve(p)
+			endSpan(span, err)
+			return result, err
+		}
+	})
+}
+
+// contextStore is implemented by stores that trace their own reads as part of a request.
+type contextStore interface {
+	withContext(ctx context.Context) PersonStore
+}
+
+// tracedStore creates a span for every call to a store.
+type tracedStore struct {
+	store PersonStore
+	ctx   context.Context
+}
+
+func traceStore(ctx context.Context, store PersonStore) PersonStore {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return store
+	}
+	return &tracedStore{store: store, ctx: ctx}
+}
+
+// start starts the span of a call and returns the store that reads as part of it.
+func (s *tracedStore) start(name string, attributes ...attribute.KeyValue) (PersonStore, trace.Span) {
+	ctx, span := tracer.Start(s.ctx, "store."+name, trace.WithAttributes(attributes...))
+	if store, ok := s.store.(contextStore); ok {
+		return store.withContext(ctx), span
+	}
+	return s.store, span
+}
+
+func (s *tracedStore) Person(id int32) (person *models.Person, err error) {
+	store, span := s.start("Person", attribute.Int("person.id", int(id)))
+	defer func() { endSpan(span, err) }()
+	return store.Person(id)
+}
+
+func (s *tracedStore) ForEach(fn func(person *models.Person) error) (err error) {
+	store, span := s.start("ForEach")
+	defer func() { endSpan(span, err) }()
+	return store.ForEach(fn)
+}
+
+func (s *tracedStore) Put(people ...*models.Person) (err error) {
+	store, span := s.start("Put", attribute.Int("people", len(people)))
+	defer func() { endSpan(span, err) }()
+	return store.Put(people...)
+}
+
+func (s *tracedStore) Delete(id int32) (err error) {
+	store, span := s.start("Delete", attribute.Int("person.id", int(id)))
+	defer func() { endSpan(span, err) }()
+	return store.Delete(id)
+}
+
+func (s *tracedStore) History(id int32) (versions []Version, err error) {
+	store, span := s.start("History", attribute.Int("person.id", int(id)))
+	defer func() { endSpan(span, err) }()
+	return store.History(id)
+}
+
+func (s *tracedStore) Close() error {
+	return s.store.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	config := defaultConfig()
+	config.Tracing.Resolvers = true
+	request := httptest.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"query": "{ person { name } }"}`))
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	response := httptest.NewRecorder()
+	queryHandler(newFileStore("data.bin"), config, nil)(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", response.Code, response.Body)
+	}
+
+	parents := make(map[string]string)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %s not in the propagated trace", span.Name())
+		}
+		parent := "remote"
+		for _, other := range recorder.Ended() {
+			if other.SpanContext().SpanID() == span.Parent().SpanID() {
+				parent = other.Name()
+			}
+		}
+		parents[span.Name()] = parent
+	}
+
+	expected := map[string]string{
+		"POST /query":         "remote",
+		"graphql.parse":       "POST /query",
+		"graphql.validate":    "POST /query",
+		"graphql.execute":     "POST /query",
+		"resolve Person.name": "graphql.execute",
+		"store.ForEach":       "graphql.execute",
+		"getData":             "store.ForEach",
+	}
+	for name, parent := range expected {
+		if parents[name] != parent {
+			t.Fatalf("span %s has parent %q, expected %q (spans: %v)", name, parents[name], parent, parents)
+		}
+	}
+}
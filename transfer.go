@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// personDecoder reads people from an import file. A *rowError is returned for a
+// row that can't be imported, including people whose phone number can't be
+// normalized or that break the validation rules in models.proto; the next row can
+// still be read.
+type personDecoder interface {
+	Decode() (*models.Person, error)
+}
+
+// personEncoder writes people to an export file.
+type personEncoder interface {
+	Encode(person *models.Person) error
+	Flush() error
+}
+
+// rowError is an error in a single row of an import file.
+type rowError struct {
+	row int
+	err error
+}
+
+func (e *rowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.row, e.err)
+}
+
+// csvField reads and writes a field of a person as a CSV value.
+type csvField struct {
+	get func(person *models.Person) string
+	set func(person *models.Person, value string) error
+}
+
+// csvPaths are the default columns, in order.
+var csvPaths = []string{"id", "name", "email", "phone.number", "phone.type"}
+
+var csvFields = map[string]csvField{
+	"id": {
+		get: func(person *models.Person) string { return strconv.Itoa(int(person.Id)) },
+		set: func(person *models.Person, value string) error {
+			id, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid id %q", value)
+			}
+			person.Id = int32(id)
+			return nil
+		},
+	},
+	"name": {
+		get: func(person *models.Person) string { return person.Name },
+		set: func(person *models.Person, value string) error {
+			person.Name = value
+			return nil
+		},
+	},
+	"email": {
+		get: func(person *models.Person) string { return person.Email },
+		set: func(person *models.Person, value string) error {
+			person.Email = value
+			return nil
+		},
+	},
+	"phone.number": {
+		get: func(person *models.Person) string { return person.GetPhone().GetNumber() },
+		set: func(person *models.Person, value string) error {
+			if value != "" {
+				phone(person).Number = value
+			}
+			return nil
+		},
+	},
+	"phone.type": {
+		get: func(person *models.Person) string {
+			if person.Phone == nil {
+				return ""
+			}
+			return person.Phone.Type.String()
+		},
+		set: func(person *models.Person, value string) error {
+			if value == "" {
+				return nil
+			}
+			phoneType, ok := models.PhoneType_value[strings.ToUpper(value)]
+			if !ok {
+				return fmt.Errorf("invalid phone type %q", value)
+			}
+			phone(person).Type = models.PhoneType(phoneType)
+			return nil
+		},
+	},
+}
+
+func phone(person *models.Person) *models.PhoneNumber {
+	if person.Phone == nil {
+		person.Phone = &models.PhoneNumber{}
+	}
+	return person.Phone
+}
+
+// importCommand streams the people in a file into the person store.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	stores := addStoreFlags(flags)
+	format := flags.String("format", "ndjson", "file format: ndjson, csv or proto")
+	columns := flags.String("columns", "", "CSV column mapping as header=path pairs, e.g. Phone=phone.number")
+	batch := flags.Int("batch", 1000, "number of people stored per transaction")
+	auditPath := flags.String("audit", "", "audit log the changes are appended to")
+	key := flags.String("hash-key", "", "secret that keys the hashes of the changed fields in the audit log, masking.hashKey of the configuration by default")
+	region := addPhoneRegionFlag(flags)
+	flags.Parse(args)
+
+	err := usePhoneRegion(*region)
+	if err == nil && *auditPath != "" {
+		err = useCommandHashKey(*key)
+	}
+	if err != nil {
+		return err
+	}
+	in, err := openInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// the store loads the keys, which the decoder needs for encrypted files
+	store, err := stores.open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	decoder, err := newPersonDecoder(*format, in, *columns)
+	if err != nil {
+		return err
+	}
+
+	audit, err := openAuditLog(*auditPath)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+	put := store.Put
+	if audit != nil {
+		trail := newAuditTrail("import")
+		audited := &auditStore{store: store, trail: trail}
+		put = func(people ...*models.Person) error {
+			err := audited.Put(people...)
+			if err != nil || len(people) == 0 {
+				return err
+			}
+			return audit.append(trail.record(commandPrincipal()))
+		}
+	}
+
+	imported, failed := 0, 0
+	var people []*models.Person
+	for {
+		person, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if rowErr, ok := err.(*rowError); ok {
+			log.Printf("skipping %v", rowErr)
+			failed++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to import: %v", err)
+		}
+
+		people = append(people, person)
+		if len(people) >= *batch {
+			err = put(people...)
+			if err != nil {
+				return fmt.Errorf("failed to import: %v", err)
+			}
+			imported += len(people)
+			people = people[:0]
+		}
+	}
+
+	err = put(people...)
+	if err != nil {
+		return fmt.Errorf("failed to import: %v", err)
+	}
+	imported += len(people)
+
+	log.Printf("imported %d people", imported)
+	if failed > 0 {
+		return fmt.Errorf("%d rows could not be imported", failed)
+	}
+	return nil
+}
+
+// exportCommand streams the people in the person store to a file.
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	stores := addStoreFlags(flags)
+	format := flags.String("format", "ndjson", "file format: ndjson, csv or proto")
+	columns := flags.String("columns", "", "CSV columns as header=path pairs or paths, e.g. id,Phone=phone.number")
+	mask := flags.String("mask", maskPolicy, "masking policy of the fields with a mask in models.proto: mask, hash, drop or none")
+	key := flags.String("hash-key", "", "secret that keys the hashes of -mask hash, masking.hashKey of the configuration by default")
+	flags.Parse(args)
+
+	switch *mask {
+	case "none", maskPolicy, dropPolicy:
+	case hashPolicy:
+		err := useCommandHashKey(*key)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown masking policy %q", *mask)
+	}
+
+	// a file is written next to its target and moved over it once it's complete,
+	// so a failed export leaves the target as it was
+	out := os.Stdout
+	var file *os.File
+	name := flags.Arg(0)
+	if name != "" && name != "-" {
+		var err error
+		file, err = ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+		if err != nil {
+			return fmt.Errorf("failed to export: %v", err)
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		out = file
+	}
+
+	encoder, err := newPersonEncoder(*format, out, *columns)
+	if err != nil {
+		return err
+	}
+
+	store, err := stores.open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	encode := encoder.Encode
+	if *mask != "none" {
+		encode = func(person *models.Person) error {
+			return encoder.Encode(maskPerson(*mask, person))
+		}
+	}
+	err = store.ForEach(encode)
+	if err == nil {
+		err = encoder.Flush()
+	}
+	if err == nil && file != nil {
+		err = file.Sync()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(file.Name(), name)
+		}
+		if err == nil {
+			err = syncDir(filepath.Dir(name))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to export: %v", err)
+	}
+	return nil
+}
+
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "" || name == "-" {
+		return os.Stdin, nil
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import: %v", err)
+	}
+	return file, nil
+}
+
+func newPersonDecoder(format string, r io.Reader, columns string) (personDecoder, error) {
+	switch format {
+	case "ndjson":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, maxRecordSize)
+		return &ndjsonDecoder{scanner: scanner}, nil
+	case "csv":
+		mapping, _, err := parseColumns(columns)
+		if err != nil {
+			return nil, err
+		}
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		return &csvDecoder{reader: reader, mapping: mapping}, nil
+	case "proto":
+		return &protoDecoder{reader: newPersonReader(r)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func newPersonEncoder(format string, w io.Writer, columns string) (personEncoder, error) {
+	switch format {
+	case "ndjson":
+		return &ndjsonEncoder{w: bufio.NewWriter(w)}, nil
+	case "csv":
+		_, ordered, err := parseColumns(columns)
+		if err != nil {
+			return nil, err
+		}
+		return &csvEncoder{writer: csv.NewWriter(w), columns: ordered}, nil
+	case "proto":
+		return newPersonWriter(w), nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// csvColumn is a CSV column and the field path it holds.
+type csvColumn struct {
+	header string
+	path   string
+}
+
+// parseColumns parses a column mapping of comma separated header=path pairs, where
+// a path on its own is used as header as well. It returns the mapping from header
+// to path and the columns in order. Without a mapping, all fields are columns.
+func parseColumns(columns string) (map[string]string, []csvColumn, error) {
+	var ordered []csvColumn
+	if columns == "" {
+		for _, path := range csvPaths {
+			ordered = append(ordered, csvColumn{header: path, path: path})
+		}
+	}
+	for _, column := range strings.Split(columns, ",") {
+		if column == "" {
+			continue
+		}
+		header, path := column, column
+		if i := strings.LastIndex(column, "="); i >= 0 {
+			header, path = column[:i], column[i+1:]
+		}
+		if _, ok := csvFields[path]; !ok {
+			return nil, nil, fmt.Errorf("unknown field %q in column %q", path, header)
+		}
+		ordered = append(ordered, csvColumn{header: header, path: path})
+	}
+
+	mapping := make(map[string]string)
+	for _, path := range csvPaths {
+		mapping[path] = path
+	}
+	for _, column := range ordered {
+		mapping[column.header] = column.path
+	}
+	return mapping, ordered, nil
+}
+
+type ndjsonDecoder struct {
+	scanner *bufio.Scanner
+	row     int
+}
+
+func (d *ndjsonDecoder) Decode() (*models.Person, error) {
+	for d.scanner.Scan() {
+		d.row++
+		line := strings.TrimSpace(d.scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		person := &models.Person{}
+		err := jsonpb.UnmarshalString(line, person)
+		if err == nil {
+			err = normalizePerson(person)
+		}
+		if err != nil {
+			return nil, &rowError{row: d.row, err: err}
+		}
+		return person, nil
+	}
+
+	if err := d.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+type ndjsonEncoder struct {
+	w         *bufio.Writer
+	marshaler jsonpb.Marshaler
+}
+
+func (e *ndjsonEncoder) Encode(person *models.Person) error {
+	err := e.marshaler.Marshal(e.w, person)
+	if err != nil {
+		return err
+	}
+	return e.w.WriteByte('\n')
+}
+
+func (e *ndjsonEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+type csvDecoder struct {
+	reader  *csv.Reader
+	mapping map[string]string
+	paths   []string
+	row     int
+}
+
+func (d *csvDecoder) Decode() (*models.Person, error) {
+	if d.paths == nil {
+		headers, err := d.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		d.row++
+
+		// columns that don't map to a field are ignored
+		d.paths = make([]string, len(headers))
+		for i, header := range headers {
+			d.paths[i] = d.mapping[strings.TrimSpace(header)]
+		}
+	}
+
+	record, err := d.reader.Read()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	d.row++
+	if _, ok := err.(*csv.ParseError); ok {
+		return nil, &rowError{row: d.row, err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	person := &models.Person{}
+	for i, value := range record {
+		if i >= len(d.paths) || d.paths[i] == "" {
+			continue
+		}
+		err = csvFields[d.paths[i]].set(person, value)
+		if err != nil {
+			return nil, &rowError{row: d.row, err: fmt.Errorf("column %s: %v", d.paths[i], err)}
+		}
+	}
+	err = normalizePerson(person)
+	if err != nil {
+		return nil, &rowError{row: d.row, err: err}
+	}
+	return person, nil
+}
+
+type csvEncoder struct {
+	writer  *csv.Writer
+	columns []csvColumn
+	started bool
+}
+
+func (e *csvEncoder) Encode(person *models.Person) error {
+	if !e.started {
+		e.started = true
+		err := e.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+
+	record := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		record[i] = csvFields[column.path].get(person)
+	}
+	return e.writer.Write(record)
+}
+
+func (e *csvEncoder) Flush() error {
+	if !e.started {
+		e.started = true
+		err := e.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvEncoder) writeHeader() error {
+	headers := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		headers[i] = column.header
+	}
+	return e.writer.Write(headers)
+}
+
+type protoDecoder struct {
+	reader *personReader
+}
+
+func (d *protoDecoder) Decode() (*models.Person, error) {
+	data, err := d.reader.NextRecord()
+	if err != nil {
+		return nil, err
+	}
+
+	// the length prefix is intact, so the stream continues after a message that doesn't decode
+	person := &models.Person{}
+	err = proto.Unmarshal(data, person)
+	if err == nil {
+		err = normalizePerson(person)
+	}
+	if err != nil {
+		return nil, &rowError{row: d.reader.Count(), err: err}
+	}
+	return person, nil
+}
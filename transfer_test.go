@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransferFormats(t *testing.T) {
+	people := []*models.Person{
+		{Id: 32, Name: "Jaap Joosten", Email: "jaap@joosten", Phone: &models.PhoneNumber{Number: "+3153218622189", Type: models.PhoneType_HOME}},
+		{Id: 33, Name: "Anna, \"Ann\" Joosten"},
+	}
+
+	for _, format := range []string{"ndjson", "csv", "proto"} {
+		var buf bytes.Buffer
+		encoder, err := newPersonEncoder(format, &buf, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, person := range people {
+			err = encoder.Encode(person)
+			if err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+		}
+		err = encoder.Flush()
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		decoder, err := newPersonDecoder(format, &buf, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := decodeAll(t, decoder)
+		if len(decoded) != len(people) {
+			t.Fatalf("%s: decoded %d people, expected %d", format, len(decoded), len(people))
+		}
+		for i := range people {
+			if !people[i].Equal(decoded[i]) {
+				t.Fatalf("%s: decoded %v, expected %v", format, decoded[i], people[i])
+			}
+		}
+	}
+}
+
+func TestCSVColumnMapping(t *testing.T) {
+	input := "Full Name,ID,Phone,Kind,Notes\n" +
+		"Jaap Joosten,32,053218622189,home,x\n" +
+		"Anna Joosten,not a number,,,\n" +
+		"Piet Joosten,34,0612345678,pager,\n" +
+		"Kees Joosten,35,,,\n"
+
+	decoder, err := newPersonDecoder("csv", strings.NewReader(input), "Full Name=name,ID=id,Phone=phone.number,Kind=phone.type")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var people []*models.Person
+	var rows []int
+	for {
+		person, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if rowErr, ok := err.(*rowError); ok {
+			rows = append(rows, rowErr.row)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, person)
+	}
+
+	if !reflect.DeepEqual([]int{3, 4}, rows) {
+		t.Fatalf("unexpected failed rows: %v", rows)
+	}
+	expected := []*models.Person{
+		{Id: 32, Name: "Jaap Joosten", Phone: &models.PhoneNumber{Number: "+3153218622189", Type: models.PhoneType_HOME}},
+		{Id: 35, Name: "Kees Joosten"},
+	}
+	if len(people) != len(expected) || !expected[0].Equal(people[0]) || !expected[1].Equal(people[1]) {
+		t.Fatalf("unexpected people: %v", people)
+	}
+}
+
+func decodeAll(t *testing.T, decoder personDecoder) []*models.Person {
+	var people []*models.Person
+	for {
+		person, err := decoder.Decode()
+		if err == io.EOF {
+			return people
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		people = append(people, person)
+	}
+}
+
+func TestExportFailure(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// a failed export leaves the file it would replace as it was
+	out := filepath.Join(dir, "people.ndjson")
+	err := ioutil.WriteFile(out, []byte("previous export\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exportCommand([]string{"-data", filepath.Join(dir, "missing.bin"), out})
+	if err == nil {
+		t.Fatal("exported a missing store")
+	}
+	exported, err := ioutil.ReadFile(out)
+	if err != nil || string(exported) != "previous export\n" {
+		t.Fatalf("failed export changed the file to %q: %v", exported, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected files %v: %v", files, err)
+	}
+}
+
+func TestExportMasked(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// the fields with a mask are masked unless that is turned off
+	out := filepath.Join(dir, "people.ndjson")
+	for _, test := range []struct {
+		args            []string
+		expected, other string
+	}{
+		{nil, "j***@joosten", "jaap@joosten"},
+		{[]string{"-mask", "none"}, "jaap@joosten", "j***@joosten"},
+		{[]string{"-mask", "hash", "-hash-key", testHashKey}, keyedHash("jaap@joosten"), "jaap@joosten"},
+	} {
+		err := exportCommand(append(test.args, "-data", "data.bin", out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(exported), test.expected) || strings.Contains(string(exported), test.other) {
+			t.Fatalf("%v: unexpected export %s", test.args, exported)
+		}
+	}
+
+	err := exportCommand([]string{"-mask", "", "-data", "data.bin", out})
+	if err == nil {
+		t.Fatal("exported with an empty masking policy")
+	}
+
+	// the key of the hashes is taken from the environment without -hash-key
+	defer useHashKey("")
+	err = exportCommand([]string{"-mask", "hash", "-data", "data.bin", out})
+	if err == nil {
+		t.Fatal("exported hashes without a key")
+	}
+	os.Setenv("GQLPB_MASKING_HASH_KEY", testHashKey)
+	defer os.Unsetenv("GQLPB_MASKING_HASH_KEY")
+	err = exportCommand([]string{"-mask", "hash", "-data", "data.bin", out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := ioutil.ReadFile(out)
+	if err != nil || !strings.Contains(string(exported), keyedHash("jaap@joosten")) {
+		t.Fatalf("unexpected export %s: %v", exported, err)
+	}
+}
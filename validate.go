@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+)
+
+// inputError is an argument that breaks a validation rule in models.proto, which
+// is reported to the client with the path of the field.
+type inputError struct {
+	argument string
+	field    *models.FieldError
+}
+
+func (e *inputError) Error() string {
+	return fmt.Sprintf("invalid argument %s: %s %s", e.argument, e.field.Path, e.field.Message)
+}
+
+func (e *inputError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "BAD_USER_INPUT", "field": e.field.Path, "rule": e.field.Rule}
+}
+
+// validateArgument checks an argument against the rules of the field at path of
+// a person that holds the argument, ignoring the other fields.
+func validateArgument(argument string, person *models.Person, path string) error {
+	invalid, ok := person.Validate().(*models.ValidationError)
+	if !ok {
+		return nil
+	}
+	if field := invalid.Field(path); field != nil {
+		return &inputError{argument: argument, field: field}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateArgument(t *testing.T) {
+	_, err := execute(context.Background(), queryRequest{Query: `{ person(id: -1) { name } }`}, newFileStore("data.bin"))
+	failed, ok := err.(*queryError)
+	if !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	extensions := failed.errors[0].Extensions
+	if extensions["code"] != "BAD_USER_INPUT" || extensions["field"] != "id" || extensions["rule"] != "min" {
+		t.Fatalf("unexpected error %v", failed.errors)
+	}
+}
+
+func TestValidateImport(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	data, in := filepath.Join(dir, "data.bin"), filepath.Join(dir, "people.ndjson")
+
+	people := `{"id":32,"name":"Jaap Joosten"}` + "\n" +
+		`{"id":33}` + "\n" +
+		`{"id":34,"name":"Anna Joosten","email":"anna"}` + "\n" +
+		`{"id":35,"name":"Piet Joosten","phone":{"number":"06-12"}}`
+	err := ioutil.WriteFile(in, []byte(people), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = importCommand([]string{"-data", data, in})
+	if err == nil || !strings.Contains(err.Error(), "3 rows") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	store := newFileStore(data)
+	for id, imported := range map[int32]bool{32: true, 33: false, 34: false, 35: false} {
+		person, err := store.Person(id)
+		if err != nil || (person != nil) != imported {
+			t.Fatalf("person %d: unexpected %v, %v", id, person, err)
+		}
+	}
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"github.com/golang/protobuf/proto"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	walPut    = 1
+	walDelete = 2
+)
+
+const (
+	walLogFile      = "wal.log"
+	walSnapshotFile = "snapshot.bin"
+	walHistoryFile  = "history.log"
+	// compactSize is the log size after which the log is folded into the snapshot.
+	compactSize = 4 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errTornRecord = errors.New("torn record")
+
+// retention limits the history that is kept when the log is compacted.
+var retention Retention
+
+// walRecord is a single atomic change in the write-ahead log.
+type walRecord struct {
+	seq     uint64
+	time    int64
+	entries []walEntry
+}
+
+type walEntry struct {
+	op     byte
+	person *models.Person
+	data   []byte
+	id     int32
+}
+
+// walStore keeps the people in memory and makes every change durable by appending
+// it to a log before it is applied. The log is replayed on startup on top of the
+// latest snapshot, and compacted into a new snapshot in the background once it
+// grows beyond compactSize. The snapshot is a regular data file. Compacted records
+// are moved to the history log, which keeps the earlier versions of every person.
+type walStore struct {
+	dir string
+
+	mu         sync.RWMutex
+	people     map[int32]*models.Person
+	history    map[int32][]Version
+	historySeq uint64
+	log        *os.File
+	size       int64
+	seq        uint64
+	closed     bool
+
+	compactMu sync.Mutex
+	compact   chan struct{}
+	done      chan struct{}
+}
+
+func openWALStore(dir string) (*walStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %v", err)
+	}
+
+	s := &walStore{
+		dir:     dir,
+		people:  make(map[int32]*models.Person),
+		history: make(map[int32][]Version),
+		compact: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	err = s.replayHistory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %v", err)
+	}
+
+	err = getData(context.Background(), s.snapshotPath(), func(person *models.Person) error {
+		s.people[person.Id] = person
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open store: %v", err)
+	}
+
+	err = s.replay()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %v", err)
+	}
+
+	go s.compactor()
+	return s, nil
+}
+
+func (s *walStore) Person(id int32) (*models.Person, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// return a copy, so the caller can't change the stored person
+	person, ok := s.people[id]
+	if !ok {
+		return nil, nil
+	}
+	return proto.Clone(person).(*models.Person), nil
+}
+
+func (s *walStore) ForEach(fn func(person *models.Person) error) error {
+	s.mu.RLock()
+	people := s.sorted()
+	s.mu.RUnlock()
+
+	for _, person := range people {
+		err := fn(proto.Clone(person).(*models.Person))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *walStore) Put(people ...*models.Person) error {
+	entries := make([]walEntry, len(people))
+	for i, person := range people {
+		data, err := proto.Marshal(person)
+		if err != nil {
+			return fmt.Errorf("failed to write person %d: %v", person.Id, err)
+		}
+
+		// keep a copy, so the caller can't change the stored person
+		stored := &models.Person{}
+		err = proto.Unmarshal(data, stored)
+		if err != nil {
+			return fmt.Errorf("failed to write person %d: %v", person.Id, err)
+		}
+		entries[i] = walEntry{op: walPut, person: stored, data: data}
+	}
+	return s.append(entries)
+}
+
+func (s *walStore) Delete(id int32) error {
+	return s.append([]walEntry{{op: walDelete, id: id}})
+}
+
+func (s *walStore) History(id int32) ([]Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored := s.history[id]
+	versions := make([]Version, len(stored))
+	for i, version := range stored {
+		if version.Person != nil {
+			version.Person = proto.Clone(version.Person).(*models.Person)
+		}
+		versions[len(stored)-1-i] = version
+	}
+	return versions, nil
+}
+
+func (s *walStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.compact)
+	s.mu.Unlock()
+
+	<-s.done
+	return s.log.Close()
+}
+
+// Compact writes the current state to a new snapshot and removes the records it
+// contains from the log. Records appended while the snapshot is written are kept.
+func (s *walStore) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.RLock()
+	people := s.sorted()
+	offset := s.size
+	s.mu.RUnlock()
+
+	// replaying records that are already part of the snapshot yields the same
+	// state, so a crash between writing the snapshot and the log is harmless
+	err := writeData(s.snapshotPath(), people)
+	if err != nil {
+		return err
+	}
+
+	// records that are already in the history log are skipped on replay by their sequence number
+	if retention == (Retention{}) {
+		compacted := make([]byte, offset)
+		_, err = s.log.ReadAt(compacted, 0)
+		if err == nil {
+			err = appendFile(filepath.Join(s.dir, walHistoryFile), compacted)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to compact log: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if retention != (Retention{}) {
+		// the history holds every record up to the last one, so the history log is
+		// written again with only the versions that are retained
+		s.prune(time.Now())
+		err = writeWALHistory(filepath.Join(s.dir, walHistoryFile), s.history)
+		if err != nil {
+			return fmt.Errorf("failed to compact history: %v", err)
+		}
+	}
+
+	tail := make([]byte, s.size-offset)
+	_, err = s.log.ReadAt(tail, offset)
+	if err == nil && len(tail) == 0 {
+		// an empty record keeps the sequence number across compactions
+		tail, err = encodeWALRecord(walRecord{seq: s.seq, time: time.Now().UnixNano()})
+	}
+	if err == nil {
+		err = s.replaceLog(tail)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compact log: %v", err)
+	}
+	return nil
+}
+
+// Rekey writes the history log, the snapshot and the log again, encrypted with the
+// current key. The whole log is moved to the snapshot and the history.
+func (s *walStore) Rekey() (int, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the history holds every record up to the last one, so the log can be emptied
+	err := writeWALHistory(filepath.Join(s.dir, walHistoryFile), s.history)
+	if err == nil {
+		err = writeData(s.snapshotPath(), s.sorted())
+	}
+	var tail []byte
+	if err == nil {
+		tail, err = encodeWALRecord(walRecord{seq: s.seq, time: time.Now().UnixNano()})
+	}
+	if err == nil {
+		err = s.replaceLog(tail)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt log: %v", err)
+	}
+	return len(s.people), nil
+}
+
+// prune removes the versions from the history that are beyond the retention. The
+// current version of a person is always kept, and a deleted person is forgotten
+// once only its deletion is left.
+func (s *walStore) prune(now time.Time) {
+	for id, versions := range s.history {
+		first := 0
+		if retention.MaxVersions > 0 && int64(len(versions)) > retention.MaxVersions {
+			first = len(versions) - int(retention.MaxVersions)
+		}
+		if retention.MaxAge > 0 {
+			// a version is dated when it was stored, so it was replaced when the next one was
+			for first < len(versions)-1 && now.Sub(versions[first+1].Time) > retention.MaxAge {
+				first++
+			}
+		}
+		versions = versions[first:]
+		if len(versions) == 1 && versions[0].Person == nil {
+			delete(s.history, id)
+			continue
+		}
+		s.history[id] = versions
+	}
+}
+
+// replaceLog replaces the log with the given records and appends to it from then on.
+func (s *walStore) replaceLog(data []byte) error {
+	path := s.logPath()
+	err := writeFile(path+".tmp", data)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.log.Close()
+	s.log, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.size = int64(len(data))
+	return nil
+}
+
+// writeWALHistory replaces the history log with the versions in a history, as the
+// records they were stored by.
+func writeWALHistory(path string, history map[int32][]Version) error {
+	records := make(map[uint64]*walRecord)
+	for id, versions := range history {
+		for _, version := range versions {
+			record, ok := records[version.Seq]
+			if !ok {
+				record = &walRecord{seq: version.Seq, time: version.Time.UnixNano()}
+				records[version.Seq] = record
+			}
+			if version.Person == nil {
+				record.entries = append(record.entries, walEntry{op: walDelete, id: id})
+				continue
+			}
+			data, err := proto.Marshal(version.Person)
+			if err != nil {
+				return fmt.Errorf("failed to write version %d of person %d: %v", version.Seq, id, err)
+			}
+			record.entries = append(record.entries, walEntry{op: walPut, person: version.Person, data: data})
+		}
+	}
+
+	seqs := make([]uint64, 0, len(records))
+	for seq := range records {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var data []byte
+	for _, seq := range seqs {
+		frame, err := encodeWALRecord(*records[seq])
+		if err != nil {
+			return err
+		}
+		data = append(data, frame...)
+	}
+
+	err := writeFile(path+".tmp", data)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	return err
+}
+
+func (s *walStore) append(entries []walEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("store is closed")
+	}
+
+	record := walRecord{seq: s.seq + 1, time: time.Now().UnixNano(), entries: entries}
+	data, err := encodeWALRecord(record)
+	if err != nil {
+		return fmt.Errorf("failed to write log: %v", err)
+	}
+
+	_, err = s.log.Write(data)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		// drop whatever part of the record made it to the log
+		s.log.Truncate(s.size)
+		return fmt.Errorf("failed to write log: %v", err)
+	}
+
+	s.size += int64(len(data))
+	s.apply(record)
+
+	if s.size >= compactSize {
+		select {
+		case s.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// replay applies the records in the log.
+func (s *walStore) replay() error {
+	file, err := os.OpenFile(s.logPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	offset, err := readWALFile(file, s.apply)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.log = file
+	s.size = offset
+	return nil
+}
+
+// replayHistory reads the versions in the history log.
+func (s *walStore) replayHistory() error {
+	file, err := os.OpenFile(filepath.Join(s.dir, walHistoryFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = readWALFile(file, s.addVersions)
+	return err
+}
+
+func (s *walStore) apply(record walRecord) {
+	s.addVersions(record)
+	for _, entry := range record.entries {
+		switch entry.op {
+		case walPut:
+			s.people[entry.person.Id] = entry.person
+		case walDelete:
+			delete(s.people, entry.id)
+		}
+	}
+	s.seq = record.seq
+}
+
+// addVersions adds the changes in a record to the history, unless the record is
+// already in it.
+func (s *walStore) addVersions(record walRecord) {
+	if record.seq <= s.historySeq {
+		return
+	}
+
+	at := time.Unix(0, record.time)
+	for _, entry := range record.entries {
+		switch entry.op {
+		case walPut:
+			s.history[entry.person.Id] = append(s.history[entry.person.Id], Version{Seq: record.seq, Time: at, Person: entry.person})
+		case walDelete:
+			if versions := s.history[entry.id]; len(versions) > 0 && versions[len(versions)-1].Person != nil {
+				s.history[entry.id] = append(versions, Version{Seq: record.seq, Time: at})
+			}
+		}
+	}
+	s.historySeq = record.seq
+}
+
+// useRetention limits the history that the wal stores keep when they compact their logs.
+func useRetention(config Retention) error {
+	if config.MaxVersions < 0 || config.MaxAge < 0 {
+		return errors.New("retention must not be negative")
+	}
+	retention = config
+	return nil
+}
+
+func (s *walStore) compactor() {
+	defer close(s.done)
+	for range s.compact {
+		err := s.Compact()
+		if err != nil {
+			log.Printf("failed to compact %s: %v", s.dir, err)
+		}
+	}
+}
+
+func (s *walStore) sorted() []*models.Person {
+	people := make([]*models.Person, 0, len(s.people))
+	for _, person := range s.people {
+		people = append(people, person)
+	}
+	sort.Slice(people, func(i, j int) bool {
+		return people[i].Id < people[j].Id
+	})
+	return people
+}
+
+func (s *walStore) logPath() string {
+	return filepath.Join(s.dir, walLogFile)
+}
+
+func (s *walStore) snapshotPath() string {
+	return filepath.Join(s.dir, walSnapshotFile)
+}
+
+// walRecordData binds an encrypted record to its sequence number, like the values
+// of the bolt store to their key.
+func walRecordData(seq uint64) []byte {
+	return valueData([]byte("wal"), binary.BigEndian.AppendUint64(nil, seq))
+}
+
+// encodeWALRecord frames a record as its length, the payload and a CRC-32C of the
+// payload. When a keyfile is configured the payload is the sequence number and the
+// record, encrypted in an envelope of its own.
+func encodeWALRecord(record walRecord) ([]byte, error) {
+	var payload []byte
+	payload = binary.AppendUvarint(payload, record.seq)
+	payload = binary.AppendVarint(payload, record.time)
+	payload = binary.AppendUvarint(payload, uint64(len(record.entries)))
+	for _, entry := range record.entries {
+		payload = append(payload, entry.op)
+		switch entry.op {
+		case walPut:
+			payload = binary.AppendUvarint(payload, uint64(len(entry.data)))
+			payload = append(payload, entry.data...)
+		case walDelete:
+			payload = binary.AppendVarint(payload, int64(entry.id))
+		}
+	}
+
+	if dataKeys != nil {
+		sealed, err := sealValue(payload, walRecordData(record.seq))
+		if err != nil {
+			return nil, err
+		}
+		payload = append(binary.AppendUvarint(nil, record.seq), sealed...)
+	}
+
+	frame := binary.AppendUvarint(nil, uint64(len(payload)))
+	frame = append(frame, payload...)
+	return binary.LittleEndian.AppendUint32(frame, crc32.Checksum(payload, crcTable)), nil
+}
+
+// readWALFile calls fn for every record in a log file and returns the size of the
+// records read. A record that was only partially written when the process stopped,
+// which is the last record, is cut off. A corrupt record before the last one is an
+// error, as cutting it off would lose the committed records after it.
+func readWALFile(file *os.File, fn func(record walRecord)) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		payload, n, err := readWALFrame(reader)
+		if err == io.EOF {
+			return offset, nil
+		}
+		// only a record whose frame reaches the end of the log can be torn
+		if err != nil && err != errTornRecord && n < info.Size()-offset {
+			return offset, fmt.Errorf("log %s is corrupt at offset %d: %v", file.Name(), offset, err)
+		}
+		if err != nil {
+			log.Printf("discarding log %s after offset %d: %v", file.Name(), offset, err)
+			err = file.Truncate(offset)
+			if err == nil {
+				err = file.Sync()
+			}
+			return offset, err
+		}
+
+		// a record that isn't torn but doesn't decode isn't cut off either
+		record, err := decodeWALPayload(payload)
+		if err != nil {
+			return offset, fmt.Errorf("log %s has an invalid record at offset %d: %v", file.Name(), offset, err)
+		}
+		fn(record)
+		offset += n
+	}
+}
+
+// readWALFrame reads the payload of the next record and the number of bytes it
+// occupies. It returns io.EOF at a clean end of the log, errTornRecord for a record
+// that runs past the end and another error for a corrupt record, with its declared size.
+func readWALFrame(r *bufio.Reader) ([]byte, int64, error) {
+	size, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return nil, 0, errTornRecord
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid record size: %v", err)
+	}
+	if size > maxRecordSize {
+		// the size is only compared with the rest of the log
+		return nil, math.MaxInt64, fmt.Errorf("record too large: %d bytes", size)
+	}
+
+	frame := make([]byte, size+4)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, 0, errTornRecord
+	}
+
+	n := int64(len(binary.AppendUvarint(nil, size))) + int64(len(frame))
+	payload := frame[:size]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(frame[size:]) {
+		return nil, n, fmt.Errorf("checksum mismatch")
+	}
+	return payload, n, nil
+}
+
+// decodeWALPayload decodes the payload of a record, which is decrypted when it is
+// encrypted. Records that aren't encrypted are refused when a keyfile is configured.
+func decodeWALPayload(payload []byte) (walRecord, error) {
+	seq, n := binary.Uvarint(payload)
+	if n > 0 && bytes.HasPrefix(payload[n:], []byte(encryptionMagic)) {
+		plain, err := openValue(payload[n:], walRecordData(seq))
+		if err != nil {
+			return walRecord{}, fmt.Errorf("failed to decrypt record %d: %v", seq, err)
+		}
+		record, err := decodeWALRecord(plain)
+		if err == nil && record.seq != seq {
+			err = fmt.Errorf("record %d holds record %d", seq, record.seq)
+		}
+		return record, err
+	}
+	if dataKeys != nil {
+		return walRecord{}, errPlainData
+	}
+	return decodeWALRecord(payload)
+}
+
+func decodeWALRecord(payload []byte) (walRecord, error) {
+	r := bytes.NewReader(payload)
+	var record walRecord
+	var err error
+
+	record.seq, err = binary.ReadUvarint(r)
+	if err != nil {
+		return record, fmt.Errorf("invalid record: %v", err)
+	}
+	record.time, err = binary.ReadVarint(r)
+	if err != nil {
+		return record, fmt.Errorf("invalid record: %v", err)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(len(payload)) {
+		return record, fmt.Errorf("invalid record entry count")
+	}
+
+	for i := uint64(0); i < count; i++ {
+		op, err := r.ReadByte()
+		if err != nil {
+			return record, fmt.Errorf("invalid record entry: %v", err)
+		}
+
+		switch op {
+		case walPut:
+			size, err := binary.ReadUvarint(r)
+			if err != nil || size > uint64(r.Len()) {
+				return record, fmt.Errorf("invalid put entry")
+			}
+			data := make([]byte, size)
+			r.Read(data)
+
+			person := &models.Person{}
+			err = proto.Unmarshal(data, person)
+			if err != nil {
+				return record, fmt.Errorf("invalid put entry: %v", err)
+			}
+			record.entries = append(record.entries, walEntry{op: walPut, person: person, data: data})
+		case walDelete:
+			id, err := binary.ReadVarint(r)
+			if err != nil {
+				return record, fmt.Errorf("invalid delete entry: %v", err)
+			}
+			record.entries = append(record.entries, walEntry{op: walDelete, id: int32(id)})
+		default:
+			return record, fmt.Errorf("unknown record entry %d", op)
+		}
+	}
+
+	return record, nil
+}
+
+func writeFile(path string, data []byte) error {
+	return syncWrite(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+}
+
+func appendFile(path string, data []byte) error {
+	return syncWrite(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, data)
+}
+
+func syncWrite(path string, flag int, data []byte) error {
+	file, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
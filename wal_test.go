@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"github.com/FactomProject/graphql-meets-protobuf-sample/models"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWALStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testPersonStore(t, store)
+}
+
+func TestWALRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// write a log and remember the state after every record
+	store, err := openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := []func() error{
+		func() error { return store.Put(&models.Person{Id: 1, Name: "Jaap Joosten"}) },
+		func() error {
+			return store.Put(&models.Person{Id: 2, Name: "Anna Joosten"}, &models.Person{Id: 3, Name: "Piet Joosten"})
+		},
+		func() error { return store.Delete(1) },
+		func() error { return store.Put(&models.Person{Id: 2, Name: "Anna de Vries", Email: "anna@devries"}) },
+	}
+	offsets := []int64{0}
+	states := [][]string{nil}
+	for _, change := range changes {
+		err = change()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, store.size)
+		states = append(states, storedNames(t, store))
+	}
+	store.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, walLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cut := 0; cut <= len(data); cut++ {
+		// the expected state is the one after the last complete record
+		expected := 0
+		for i, offset := range offsets {
+			if offset <= int64(cut) {
+				expected = i
+			}
+		}
+
+		recovered := tempDir(t)
+		err = ioutil.WriteFile(filepath.Join(recovered, walLogFile), data[:cut], 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store, err := openWALStore(recovered)
+		if err != nil {
+			t.Fatalf("failed to recover log truncated at %d: %v", cut, err)
+		}
+		if names := storedNames(t, store); !reflect.DeepEqual(states[expected], names) {
+			t.Fatalf("log truncated at %d: recovered %v, expected %v", cut, names, states[expected])
+		}
+
+		// the log must accept new records after the torn one is cut off
+		err = store.Put(&models.Person{Id: 4, Name: "Kees Joosten"})
+		if err != nil {
+			t.Fatalf("failed to write to log truncated at %d: %v", cut, err)
+		}
+		store.Close()
+
+		store, err = openWALStore(recovered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		person, _ := store.Person(4)
+		if person == nil || store.seq != uint64(expected+1) {
+			t.Fatalf("record written after recovery at %d is lost", cut)
+		}
+		store.Close()
+		os.RemoveAll(recovered)
+	}
+}
+
+func TestWALCorruption(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for i, name := range []string{"Jaap Joosten", "Anna Joosten", "Piet Joosten", "Kees Joosten"} {
+		offsets = append(offsets, store.size)
+		err = store.Put(&models.Person{Id: int32(i + 1), Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	path := filepath.Join(dir, walLogFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupt record in the middle of the log isn't cut off with the records after
+	// it, whether its payload, its size or the encoding of its size is corrupt
+	for name, corrupt := range map[string]func(data []byte){
+		"payload":  func(data []byte) { data[offsets[1]+4] ^= 0xff },
+		"size":     func(data []byte) { data[offsets[1]]-- },
+		"encoding": func(data []byte) { copy(data[offsets[1]:], bytes.Repeat([]byte{0xff}, 10)) },
+	} {
+		corrupted := append([]byte(nil), data...)
+		corrupt(corrupted)
+		err = ioutil.WriteFile(path, corrupted, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = openWALStore(dir)
+		if err == nil {
+			t.Fatalf("%s: opened a log with a corrupt record", name)
+		}
+		after, _ := ioutil.ReadFile(path)
+		if !reflect.DeepEqual(corrupted, after) {
+			t.Fatalf("%s: corrupt log was changed from %d to %d bytes", name, len(corrupted), len(after))
+		}
+	}
+
+	// the records after the corrupt one are still there once it is repaired
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := storedNames(t, store); len(names) != 4 {
+		t.Fatalf("records lost: %v", names)
+	}
+	store.Close()
+
+	// a corrupt last record is a torn write
+	corrupt := append([]byte(nil), data...)
+	corrupt[offsets[3]+4] ^= 0xff
+	err = ioutil.WriteFile(path, corrupt, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if names := storedNames(t, store); !reflect.DeepEqual(names, []string{"Jaap Joosten", "Anna Joosten", "Piet Joosten"}) {
+		t.Fatalf("recovered %v", names)
+	}
+}
+
+func TestWALClones(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	err = store.Put(&models.Person{Id: 1, Name: "Jaap Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	person, _ := store.Person(1)
+	person.Name = "Anna Joosten"
+	store.ForEach(func(person *models.Person) error {
+		person.Name = "Piet Joosten"
+		return nil
+	})
+	if names := storedNames(t, store); !reflect.DeepEqual(names, []string{"Jaap Joosten"}) {
+		t.Fatalf("changed the stored person: %v", names)
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(&models.Person{Id: 1, Name: "Jaap Joosten"}, &models.Person{Id: 2, Name: "Anna Joosten"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Delete(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// the snapshot is a regular data file
+	snapshot := storedNames(t, newFileStore(filepath.Join(dir, walSnapshotFile)))
+	if !reflect.DeepEqual([]string{"Jaap Joosten", "Anna Joosten"}, snapshot) {
+		t.Fatalf("unexpected snapshot: %v", snapshot)
+	}
+
+	store, err = openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if names := storedNames(t, store); !reflect.DeepEqual([]string{"Anna Joosten"}, names) {
+		t.Fatalf("unexpected people after compaction: %v", names)
+	}
+	if store.seq != 2 {
+		t.Fatalf("sequence not kept across compaction: %d", store.seq)
+	}
+}
+
+func storedNames(t *testing.T, store PersonStore) []string {
+	var names []string
+	err := store.ForEach(func(person *models.Person) error {
+		names = append(names, person.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestWALRetention(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer useRetention(Retention{})
+
+	store, err := openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { store.Close() }()
+
+	historySize := func() int64 {
+		info, err := os.Stat(filepath.Join(dir, walHistoryFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	for _, name := range []string{"Jaap Joosten", "Jaap de Vries", "Jaap Jansen", "Jaap Bakker"} {
+		err = store.Put(&models.Person{Id: 1, Name: name}, &models.Person{Id: 2, Name: "Anna " + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Delete(2)
+	if err == nil {
+		err = store.Compact()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbounded := historySize()
+
+	err = useRetention(Retention{MaxVersions: 2})
+	if err == nil {
+		err = store.Compact()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := historySize(); size >= unbounded {
+		t.Fatalf("history log of %d bytes not pruned from %d bytes", size, unbounded)
+	}
+
+	store.Close()
+	store, err = openWALStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	versions, _ := store.History(1)
+	for _, version := range versions {
+		names = append(names, version.Person.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"Jaap Bakker", "Jaap Jansen"}) {
+		t.Fatalf("unexpected versions %v", names)
+	}
+	if versions, _ := store.History(2); len(versions) != 2 || versions[0].Person != nil {
+		t.Fatalf("unexpected versions of a deleted person %v", versions)
+	}
+
+	// only the current version is younger than the age, and the deleted person is forgotten
+	err = useRetention(Retention{MaxAge: time.Nanosecond})
+	if err == nil {
+		err = store.Compact()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := store.History(1); len(versions) != 1 || versions[0].Person.Name != "Jaap Bakker" {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	if versions, _ := store.History(2); len(versions) != 0 {
+		t.Fatalf("deleted person kept %v", versions)
+	}
+	if names := storedNames(t, store); !reflect.DeepEqual(names, []string{"Jaap Bakker"}) {
+		t.Fatalf("unexpected people %v", names)
+	}
+
+	if useRetention(Retention{MaxVersions: -1}) == nil {
+		t.Fatal("negative retention accepted")
+	}
+}